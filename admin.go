@@ -0,0 +1,240 @@
+package main
+
+import (
+	"crypto/subtle"
+	"gopkg.in/olivere/elastic.v6"
+	"invento-search/bootstrap"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// requireAdmin only lets requests through that carry the admin token as a
+// bearer token. Admin routes are disabled entirely when no token is set.
+func requireAdmin(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token == "" {
+			http.NotFound(w, r)
+			return
+		}
+		given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "admin token required", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// resetSummary reports what /admin/reset did.
+type resetSummary struct {
+	Index   string `json:"index"`
+	Deleted bool   `json:"deleted"`
+	Created bool   `json:"created"`
+	Seeded  int    `json:"seeded"`
+}
+
+// resetHandler deletes and recreates the index with the current mapping,
+// optionally re-seeding it when called with seed=true. With
+// WRITE_REQUIRE_FILTER set it also takes confirm=true, since every item is
+// lost. It waits for the new index with readyClient, see
+// bootstrap.WaitForIndex.
+func resetHandler(cfg Config, client, readyClient *elastic.Client, store *esStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !cfg.AllowReset {
+			http.Error(w, "index reset is disabled, set ALLOW_RESET=true to enable it", http.StatusForbidden)
+			return
+		}
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if cfg.WriteRequireFilter && !confirmed(r) {
+			http.Error(w, "this deletes every item, pass confirm=true to go ahead", http.StatusBadRequest)
+			return
+		}
+
+		ctx := r.Context()
+		summary := resetSummary{Index: cfg.IndexName}
+		var err error
+		if summary.Deleted, err = bootstrap.DeleteIndex(ctx, client, cfg.IndexName); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if summary.Deleted {
+			store.events.publish(itemEvent{Type: itemsChanged, RequestID: requestID(ctx)})
+		}
+		if summary.Created, err = bootstrap.CreateIndex(ctx, client, cfg.IndexName); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := bootstrap.WaitForIndex(ctx, readyClient, cfg.IndexName, cfg.IndexReadyTimeout); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		if r.FormValue("seed") == "true" {
+			if summary.Seeded, err = seedIndex(ctx, store); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		logf(r.Context(), "Reset index %s: %+v\n", cfg.IndexName, summary)
+		writeJSON(w, r, http.StatusOK, summary)
+	}
+}
+
+// forcemergeWarning is returned with every force merge.
+const forcemergeWarning = "force merging is I/O intensive and should not be run on an index that is being written to"
+
+// forcemergeResult is the /admin/forcemerge response body.
+type forcemergeResult struct {
+	Index          string              `json:"index"`
+	MaxNumSegments int                 `json:"max_num_segments"`
+	Shards         *elastic.ShardsInfo `json:"_shards,omitempty"`
+	Warning        string              `json:"warning"`
+}
+
+// forcemergeHandler merges the index down to at most FORCEMERGE_SEGMENTS
+// segments per shard, or the segments param, to speed up searches after a
+// big import. Elasticsearch keeps merging if the request times out first.
+func forcemergeHandler(cfg Config, client *elastic.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		result := forcemergeResult{Index: cfg.IndexName, MaxNumSegments: cfg.ForcemergeSegments, Warning: forcemergeWarning}
+		if v := r.FormValue("segments"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 {
+				http.Error(w, "segments must be a positive number", http.StatusBadRequest)
+				return
+			}
+			result.MaxNumSegments = n
+		}
+
+		logf(r.Context(), "Force merging %s to %d segments\n", cfg.IndexName, result.MaxNumSegments)
+		res, err := client.Forcemerge(cfg.IndexName).MaxNumSegments(result.MaxNumSegments).Do(r.Context())
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			http.Error(w, "timed out waiting for the merge, it continues in the background: "+forcemergeWarning, http.StatusGatewayTimeout)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		result.Shards = res.Shards
+		writeJSON(w, r, http.StatusOK, result)
+	}
+}
+
+// analyzeResult is the /admin/analyze response body.
+type analyzeResult struct {
+	Analyzer string      `json:"analyzer,omitempty"`
+	Field    string      `json:"field,omitempty"`
+	Tokens   interface{} `json:"tokens"`
+}
+
+// analyzeHandler shows how text is tokenized by an analyzer, or by the
+// analyzer of a mapped field, so analysis can be checked without leaving
+// the app.
+func analyzeHandler(cfg Config, client *elastic.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		text := r.FormValue("text")
+		if text == "" {
+			http.Error(w, "text is required", http.StatusBadRequest)
+			return
+		}
+		result := analyzeResult{Analyzer: r.FormValue("analyzer"), Field: r.FormValue("field")}
+		if result.Analyzer == "" && result.Field == "" {
+			result.Analyzer = "standard"
+		}
+
+		service := client.IndexAnalyze().Index(cfg.IndexName).Text(text)
+		if result.Analyzer != "" {
+			service = service.Analyzer(result.Analyzer)
+		}
+		if result.Field != "" {
+			service = service.Field(result.Field)
+		}
+		res, err := service.Do(r.Context())
+		if elastic.IsStatusCode(err, http.StatusBadRequest) {
+			// Unknown analyzers and fields are reported as bad requests.
+			http.Error(w, esErrorReason(err), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		result.Tokens = res.Tokens
+		writeJSON(w, r, http.StatusOK, result)
+	}
+}
+
+// rawItemHandler returns an item's document exactly as Elasticsearch stores
+// it, with its version and sequence number, for when the stored source and
+// schema.Item disagree. It serves /admin/items/{id}/raw.
+func rawItemHandler(store *esStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimPrefix(r.URL.Path, "/admin/items/")
+		if !strings.HasSuffix(id, "/raw") {
+			http.NotFound(w, r)
+			return
+		}
+		id = strings.TrimSuffix(id, "/raw")
+		if id == "" {
+			http.Error(w, "id is required", http.StatusBadRequest)
+			return
+		}
+
+		res, err := store.Raw(r.Context(), id)
+		if elastic.IsNotFound(err) {
+			http.Error(w, "item "+id+" not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, r, http.StatusOK, res)
+	}
+}
+
+// mappingHandler applies additive changes to the index mapping in place.
+// Conflicting changes are refused with a 409 listing what needs a reindex.
+func mappingHandler(cfg Config, client *elastic.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "PUT" {
+			w.Header().Set("Allow", "PUT")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		update, err := updateMapping(r.Context(), client, cfg.IndexName)
+		if conflict, ok := err.(*mappingConflictError); ok {
+			http.Error(w, conflict.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		logf(r.Context(), "Updated mapping of %s, added %v\n", cfg.IndexName, update.Added)
+		writeJSON(w, r, http.StatusOK, update)
+	}
+}
+
+// esErrorReason returns the reason Elasticsearch gave for a failed request.
+func esErrorReason(err error) string {
+	if e, ok := err.(*elastic.Error); ok && e.Details != nil && e.Details.Reason != "" {
+		return e.Details.Reason
+	}
+	return err.Error()
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// resetES is a cluster where the items index exists until it's deleted.
+func resetES(req esRequest) (int, interface{}) {
+	switch {
+	case req.Method == "HEAD":
+		return http.StatusNotFound, ""
+	case strings.HasPrefix(req.Path, "/_cluster/health/"):
+		return http.StatusOK, map[string]interface{}{"status": "yellow"}
+	}
+	return http.StatusOK, map[string]interface{}{"acknowledged": true}
+}
+
+func TestResetRequiresConfirm(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.AllowReset = true
+	client, es := newFakeES(t, resetES)
+	reset := resetHandler(cfg, client, client, newESStore(cfg, client, nil))
+
+	w := httptest.NewRecorder()
+	reset(w, httptest.NewRequest("POST", "/admin/reset", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("unconfirmed reset answered %d: %s", w.Code, w.Body)
+	}
+	if deletes := es.requestsTo("DELETE", "/items"); len(deletes) > 0 {
+		t.Fatal("unconfirmed reset deleted the index")
+	}
+
+	w = httptest.NewRecorder()
+	reset(w, httptest.NewRequest("POST", "/admin/reset?confirm=true", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("confirmed reset answered %d: %s", w.Code, w.Body)
+	}
+	if deletes := es.requestsTo("DELETE", "/items"); len(deletes) != 1 {
+		t.Errorf("confirmed reset deleted the index %d times", len(deletes))
+	}
+	if creates := es.requestsTo("PUT", "/items"); len(creates) != 1 {
+		t.Errorf("confirmed reset created the index %d times", len(creates))
+	}
+}
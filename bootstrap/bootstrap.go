@@ -0,0 +1,154 @@
+// Package bootstrap sets up the items index before the server takes
+// requests: it creates the index with the current mapping if it's
+// missing, waits for it to be usable and seeds it the first time round.
+package bootstrap
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"gopkg.in/olivere/elastic.v6"
+	"invento-search/schema"
+	"time"
+)
+
+// Config says which index to bootstrap and how.
+type Config struct {
+	// Index is the name of the items index.
+	Index string
+	// ReadyTimeout is how long to wait for the index to reach yellow
+	// health.
+	ReadyTimeout time.Duration
+	// ReadyClient is used to wait for the index, see WaitForIndex. Nil
+	// waits with the client given to Bootstrap.
+	ReadyClient *elastic.Client
+	// Seed fills a freshly created index and returns how many items it
+	// wrote. Nil leaves new indices empty.
+	Seed func(ctx context.Context) (int, error)
+}
+
+// Bootstrap creates the index if it doesn't exist, waits until it's ready
+// and seeds it if it was just created. An index that already existed is
+// left as it is, but it's an error if its mapping is too old to search, see
+// CheckNameMapping.
+func Bootstrap(ctx context.Context, client *elastic.Client, cfg Config) error {
+	created, err := CreateIndex(ctx, client, cfg.Index)
+	if err != nil {
+		return fmt.Errorf("creating index %s: %v", cfg.Index, err)
+	}
+	readyClient := cfg.ReadyClient
+	if readyClient == nil {
+		readyClient = client
+	}
+	if err := WaitForIndex(ctx, readyClient, cfg.Index, cfg.ReadyTimeout); err != nil {
+		return err
+	}
+	if !created {
+		if err := CheckNameMapping(ctx, client, cfg.Index); err != nil {
+			return err
+		}
+	}
+	if created && cfg.Seed != nil {
+		seeded, err := cfg.Seed(ctx)
+		if err != nil {
+			return fmt.Errorf("seeding index %s, %d items written: %v", cfg.Index, seeded, err)
+		}
+		fmt.Printf("Created index %s with %d sample items\n", cfg.Index, seeded)
+	}
+	return nil
+}
+
+// CreateIndex creates the index with the current mapping. It reports false
+// if the index already existed.
+func CreateIndex(ctx context.Context, client *elastic.Client, index string) (bool, error) {
+	exists, err := client.IndexExists(index).Do(ctx)
+	if err != nil {
+		return false, err
+	}
+	if exists {
+		return false, nil
+	}
+
+	createIndex, err := client.CreateIndex(index).BodyString(schema.Mapping).Do(ctx)
+	if err != nil {
+		return false, err
+	}
+	if !createIndex.Acknowledged {
+		fmt.Printf("Index not acknowledged")
+	}
+	return true, nil
+}
+
+// WaitForIndex blocks until the index's primary shards are allocated, so it
+// can serve requests. A freshly created index needs a moment before it does.
+//
+// Elasticsearch holds the request for up to timeout, so client must allow
+// requests to take longer than that.
+func WaitForIndex(ctx context.Context, client *elastic.Client, index string, timeout time.Duration) error {
+	_, err := client.ClusterHealth().
+		Index(index).
+		WaitForStatus("yellow").
+		Timeout(fmt.Sprintf("%dms", timeout.Milliseconds())).
+		Do(ctx)
+	// Elasticsearch answers 408 if the status isn't reached in time.
+	if elastic.IsTimeout(err) {
+		return fmt.Errorf("index %s not ready after %s", index, timeout)
+	}
+	return err
+}
+
+// CheckNameMapping returns an error if the index maps name without the
+// name.raw keyword sub-field. Indices created before name became a text
+// field map it as a keyword alone, and searches by exact name, wildcards,
+// duplicate checks and sorting all go through name.raw. Sub-fields can't
+// be added in place, so such an index needs a reindex.
+func CheckNameMapping(ctx context.Context, client *elastic.Client, index string) error {
+	res, err := client.GetMapping().Index(index).Type("item").Do(ctx)
+	if err != nil {
+		return fmt.Errorf("getting the mapping of index %s: %v", index, err)
+	}
+	// The response is keyed by concrete index name, which differs from
+	// index if it's an alias.
+	raw, err := json.Marshal(res)
+	if err != nil {
+		return err
+	}
+	var indices map[string]struct {
+		Mappings struct {
+			Item struct {
+				Properties struct {
+					Name struct {
+						Type   string                     `json:"type"`
+						Fields map[string]json.RawMessage `json:"fields"`
+					} `json:"name"`
+				} `json:"properties"`
+			} `json:"item"`
+		} `json:"mappings"`
+	}
+	if err := json.Unmarshal(raw, &indices); err != nil {
+		return err
+	}
+	for concrete, mapping := range indices {
+		name := mapping.Mappings.Item.Properties.Name
+		if _, ok := name.Fields["raw"]; !ok {
+			return fmt.Errorf("index %s maps name as %q without name.raw, it predates name becoming text and must be reindexed, see Mapping changes in the README", concrete, name.Type)
+		}
+	}
+	return nil
+}
+
+// DeleteIndex deletes the index. It reports false if there was nothing to
+// delete.
+func DeleteIndex(ctx context.Context, client *elastic.Client, index string) (bool, error) {
+	deleteIndex, err := client.DeleteIndex(index).Do(ctx)
+	if elastic.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if !deleteIndex.Acknowledged {
+		fmt.Printf("Index not acknowledged")
+	}
+	return true, nil
+}
@@ -0,0 +1,163 @@
+package bootstrap
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"gopkg.in/olivere/elastic.v6"
+	"invento-search/schema"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestClient returns a client for a fake cluster answering with handler.
+func newTestClient(t *testing.T, handler http.HandlerFunc) *elastic.Client {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	client, err := elastic.NewClient(elastic.SetURL(server.URL), elastic.SetSniff(false), elastic.SetHealthcheck(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+// respond writes a JSON response.
+func respond(w http.ResponseWriter, status int, body string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write([]byte(body))
+}
+
+const healthYellow = `{"cluster_name":"test","status":"yellow","timed_out":false}`
+
+func TestWaitForIndex(t *testing.T) {
+	var queries []string
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		queries = append(queries, r.URL.Path+"?"+r.URL.RawQuery)
+		respond(w, http.StatusOK, healthYellow)
+	})
+	if err := WaitForIndex(context.Background(), client, "items", 30*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	// Elasticsearch doesn't take Go durations such as 30s or 1m30s.
+	if len(queries) != 1 || !strings.HasPrefix(queries[0], "/_cluster/health/items?") ||
+		!strings.Contains(queries[0], "timeout=30000ms") || !strings.Contains(queries[0], "wait_for_status=yellow") {
+		t.Errorf("waited with %q", queries)
+	}
+}
+
+func TestWaitForIndexTimeout(t *testing.T) {
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		respond(w, http.StatusRequestTimeout, `{"cluster_name":"test","status":"red","timed_out":true}`)
+	})
+	err := WaitForIndex(context.Background(), client, "items", 1500*time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), "index items not ready after 1.5s") {
+		t.Errorf("WaitForIndex = %v, want a not ready error", err)
+	}
+}
+
+// existingIndex is a fake cluster with an index items-v1, aliased items,
+// mapping name as in nameMapping.
+func existingIndex(nameMapping string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "HEAD" && r.URL.Path == "/items":
+			respond(w, http.StatusOK, "")
+		case strings.HasPrefix(r.URL.Path, "/_cluster/health/"):
+			respond(w, http.StatusOK, healthYellow)
+		case r.URL.Path == "/items/_mapping/item":
+			respond(w, http.StatusOK, `{"items-v1":{"mappings":{"item":{"properties":{"name":`+nameMapping+`}}}}}`)
+		default:
+			respond(w, http.StatusBadRequest, `{"error":{"type":"unexpected","reason":"unexpected request"},"status":400}`)
+		}
+	}
+}
+
+func TestBootstrapExistingIndex(t *testing.T) {
+	client := newTestClient(t, existingIndex(`{"type":"text","fields":{"raw":{"type":"keyword"}}}`))
+	seed := func(ctx context.Context) (int, error) {
+		t.Error("an existing index was seeded")
+		return 0, nil
+	}
+	if err := Bootstrap(context.Background(), client, Config{Index: "items", ReadyTimeout: time.Second, Seed: seed}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBootstrapOldNameMapping(t *testing.T) {
+	client := newTestClient(t, existingIndex(`{"type":"keyword"}`))
+	err := Bootstrap(context.Background(), client, Config{Index: "items", ReadyTimeout: time.Second})
+	if err == nil || !strings.Contains(err.Error(), "index items-v1 maps name as \"keyword\" without name.raw") {
+		t.Errorf("Bootstrap = %v, want a reindex error", err)
+	}
+}
+
+// missingIndex is a fake cluster without the items index, recording the
+// requests it gets.
+func missingIndex(requests *[]string, created *string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		*requests = append(*requests, r.Method+" "+r.URL.Path)
+		switch {
+		case r.Method == "HEAD" && r.URL.Path == "/items":
+			respond(w, http.StatusNotFound, "")
+		case r.Method == "PUT" && r.URL.Path == "/items":
+			body, _ := io.ReadAll(r.Body)
+			*created = string(body)
+			respond(w, http.StatusOK, `{"acknowledged":true,"shards_acknowledged":true,"index":"items"}`)
+		case strings.HasPrefix(r.URL.Path, "/_cluster/health/"):
+			respond(w, http.StatusOK, healthYellow)
+		default:
+			respond(w, http.StatusBadRequest, `{"error":{"type":"unexpected","reason":"unexpected request"},"status":400}`)
+		}
+	}
+}
+
+func TestBootstrapNewIndex(t *testing.T) {
+	var requests, readyRequests []string
+	var mapping, unused string
+	client := newTestClient(t, missingIndex(&requests, &mapping))
+	readyClient := newTestClient(t, missingIndex(&readyRequests, &unused))
+	seeds := 0
+	seed := func(ctx context.Context) (int, error) {
+		seeds++
+		return 12, nil
+	}
+	cfg := Config{Index: "items", ReadyTimeout: time.Second, ReadyClient: readyClient, Seed: seed}
+	if err := Bootstrap(context.Background(), client, cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"HEAD /items", "PUT /items"}
+	if strings.Join(requests, ",") != strings.Join(want, ",") {
+		t.Errorf("bootstrapped with %q, want %q", requests, want)
+	}
+	// The wait goes through the ready client, with its longer timeout.
+	if len(readyRequests) != 1 || readyRequests[0] != "GET /_cluster/health/items" {
+		t.Errorf("waited with %q", readyRequests)
+	}
+	var got, current interface{}
+	if err := json.Unmarshal([]byte(mapping), &got); err != nil {
+		t.Fatalf("created the index with %q: %v", mapping, err)
+	}
+	json.Unmarshal([]byte(schema.Mapping), &current)
+	if !reflect.DeepEqual(got, current) {
+		t.Errorf("created the index with %s, want schema.Mapping", mapping)
+	}
+	if seeds != 1 {
+		t.Errorf("seeded %d times, want once", seeds)
+	}
+
+	// Seeding errors say how far it got.
+	requests = nil
+	cfg.Seed = func(ctx context.Context) (int, error) { return 3, errors.New("bulk rejected") }
+	err := Bootstrap(context.Background(), client, cfg)
+	if err == nil || err.Error() != "seeding index items, 3 items written: bulk rejected" {
+		t.Errorf("Bootstrap = %v, want the seeding error", err)
+	}
+}
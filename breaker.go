@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"gopkg.in/olivere/elastic.v6"
+	"html/template"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// breaker trips after a run of failed Elasticsearch requests so pages can
+// show a maintenance notice instead of erroring, and resets on the first
+// request that succeeds again.
+type breaker struct {
+	threshold int
+
+	mu       sync.Mutex
+	failures int
+	open     bool
+	lastErr  string
+}
+
+func newBreaker(threshold int) *breaker {
+	return &breaker{threshold: threshold}
+}
+
+// breakerState is the breaker as reported by /healthz.
+type breakerState struct {
+	// State is "closed" while Elasticsearch is reachable, "open" while
+	// it's down.
+	State     string `json:"state"`
+	Failures  int    `json:"failures"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+func (b *breaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.open {
+		fmt.Println("Elasticsearch is back, closing the breaker")
+	}
+	b.failures, b.open, b.lastErr = 0, false, ""
+}
+
+func (b *breaker) failure(reason string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	b.lastErr = reason
+	if !b.open && b.failures >= b.threshold {
+		fmt.Printf("Elasticsearch failed %d times in a row, opening the breaker: %s\n", b.failures, reason)
+		b.open = true
+	}
+}
+
+func (b *breaker) isOpen() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.open
+}
+
+func (b *breaker) state() breakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	state := breakerState{State: "closed", Failures: b.failures, LastError: b.lastErr}
+	if b.open {
+		state.State = "open"
+	}
+	return state
+}
+
+// breakerTransport records the outcome of every request to Elasticsearch.
+// Connection errors and gateway errors count as failures, any other
+// response means the cluster is up.
+type breakerTransport struct {
+	next    http.RoundTripper
+	breaker *breaker
+}
+
+func (t *breakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	switch {
+	case req.Context().Err() != nil:
+		// Cancelled by our side, says nothing about the cluster.
+	case err != nil:
+		t.breaker.failure(err.Error())
+	case resp.StatusCode == http.StatusBadGateway ||
+		resp.StatusCode == http.StatusServiceUnavailable ||
+		resp.StatusCode == http.StatusGatewayTimeout:
+		t.breaker.failure(resp.Status)
+	default:
+		t.breaker.success()
+	}
+	return resp, err
+}
+
+// watch pings Elasticsearch every interval until ctx is done. The pings
+// go through breakerTransport, so they close the breaker once the cluster
+// answers again even if no traffic is coming in.
+func (b *breaker) watch(ctx context.Context, client *elastic.Client, url string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			client.Ping(url).Do(ctx)
+		}
+	}
+}
+
+// guard serves next while the breaker is closed. While it's open, GETs
+// get the maintenance page and writes get a plain 503.
+func (b *breaker) guard(maintenance *template.Template, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !b.isOpen() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Retry-After", "30")
+		if r.Method != "GET" && r.Method != "HEAD" {
+			http.Error(w, "search is temporarily unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		if err := maintenance.ExecuteTemplate(w, "maintenance.html", nil); err != nil {
+			fmt.Printf("Rendering the maintenance page: %v\n", err)
+		}
+	})
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gopkg.in/olivere/elastic.v6"
+	"invento-search/schema"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// errNoBulkResult is reported for an action the bulk response has no item
+// for.
+var errNoBulkResult = errors.New("missing bulk result")
+
+// bulkResult is the outcome of an action sent through the bulk processor.
+type bulkResult struct {
+	// key is the key the action was queued with.
+	key int
+	// item is Elasticsearch's result for the action, nil if err is set.
+	item *elastic.BulkResponseItem
+	// err is set if the whole bulk failed, even after retrying.
+	err error
+}
+
+// trackedRequest is a bulk action whose result is sent on done.
+type trackedRequest struct {
+	elastic.BulkableRequest
+	key  int
+	done chan<- bulkResult
+}
+
+// bulkStats counts the actions the bulk processor committed since startup.
+type bulkStats struct {
+	succeeded uint64
+	failed    uint64
+}
+
+// StartBulk starts the store's bulk processor. Actions queued on it are
+// committed in bulks of up to actions, by workers running concurrently,
+// and at least every interval. Bulks that fail as a whole, because the
+// cluster is unreachable or overloaded, are retried with backoff.
+func (s *esStore) StartBulk(ctx context.Context, actions, workers int, interval time.Duration) error {
+	processor, err := s.client.BulkProcessor().
+		Name("items").
+		BulkActions(actions).
+		Workers(workers).
+		FlushInterval(interval).
+		Backoff(elastic.NewExponentialBackoff(100*time.Millisecond, 10*time.Second)).
+		After(s.afterBulk).
+		Do(ctx)
+	if err != nil {
+		return err
+	}
+	s.bulk = processor
+	return nil
+}
+
+// bulkAdd queues req on the bulk processor. Its result is sent on done,
+// tagged with key, and done must be received from until it is. bulkAdd
+// blocks while all workers are busy committing, which holds feeders back
+// to the pace Elasticsearch keeps up with.
+func (s *esStore) bulkAdd(req elastic.BulkableRequest, key int, done chan<- bulkResult) {
+	s.bulk.Add(&trackedRequest{BulkableRequest: req, key: key, done: done})
+}
+
+// afterBulk hands the results of a committed bulk to whoever queued the
+// actions, and logs the counts.
+func (s *esStore) afterBulk(id int64, requests []elastic.BulkableRequest, res *elastic.BulkResponse, err error) {
+	var succeeded, failed uint64
+	for i, req := range requests {
+		result := bulkResult{err: err}
+		if err == nil {
+			result.err = errNoBulkResult
+			if i < len(res.Items) {
+				// Each item has a single entry keyed by action.
+				for _, item := range res.Items[i] {
+					result.item, result.err = item, nil
+				}
+			}
+		}
+		if result.err != nil || result.item.Error != nil {
+			failed++
+		} else {
+			succeeded++
+		}
+		if tracked, ok := req.(*trackedRequest); ok {
+			result.key = tracked.key
+			tracked.done <- result
+		}
+	}
+	totalSucceeded := atomic.AddUint64(&s.bulkStats.succeeded, succeeded)
+	totalFailed := atomic.AddUint64(&s.bulkStats.failed, failed)
+	if err != nil {
+		fmt.Printf("Bulk %d failed: %v\n", id, err)
+	}
+	fmt.Printf("Bulk %d: %d succeeded, %d failed (%d succeeded, %d failed since startup)\n", id, succeeded, failed, totalSucceeded, totalFailed)
+}
+
+// bulkCollector gathers the results of the actions a request queues on the
+// store's bulk processor, keyed by the key each was queued with. It keeps
+// receiving until every result came in, even after the request stopped
+// waiting, so the processor never blocks on it.
+type bulkCollector struct {
+	store    *esStore
+	done     chan bulkResult
+	sealed   chan int
+	complete chan struct{}
+	queued   int
+
+	mu      sync.Mutex
+	results map[int]bulkResult
+}
+
+func newBulkCollector(store *esStore) *bulkCollector {
+	c := &bulkCollector{
+		store:    store,
+		done:     make(chan bulkResult),
+		sealed:   make(chan int, 1),
+		complete: make(chan struct{}),
+		results:  map[int]bulkResult{},
+	}
+	go c.run()
+	return c
+}
+
+func (c *bulkCollector) run() {
+	defer close(c.complete)
+	queued, received := -1, 0
+	for queued < 0 || received < queued {
+		select {
+		case result := <-c.done:
+			c.mu.Lock()
+			c.results[result.key] = result
+			c.mu.Unlock()
+			received++
+		case queued = <-c.sealed:
+		}
+	}
+}
+
+// add queues req under key.
+func (c *bulkCollector) add(req elastic.BulkableRequest, key int) {
+	c.store.bulkAdd(req, key, c.done)
+	c.queued++
+}
+
+// seal tells the collector nothing more is added, so it can stop once
+// the results of what was are in.
+func (c *bulkCollector) seal() {
+	c.sealed <- c.queued
+}
+
+// wait seals the collector and waits until all results came in or ctx is
+// done. It returns the results that came in.
+func (c *bulkCollector) wait(ctx context.Context) map[int]bulkResult {
+	c.seal()
+	select {
+	case <-c.complete:
+	case <-ctx.Done():
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	results := make(map[int]bulkResult, len(c.results))
+	for key, result := range c.results {
+		results[key] = result
+	}
+	return results
+}
+
+// Close commits the actions still queued on the bulk processor and stops
+// it. Nothing may be queued afterwards.
+func (s *esStore) Close() error {
+	if s.bulk == nil {
+		return nil
+	}
+	return s.bulk.Close()
+}
+
+// bulkWriter queues the writes of a bulk endpoint and collects what came of
+// them, by the key each was queued with.
+type bulkWriter interface {
+	// Put stores item under its id or SKU, see prepareItem, replacing what
+	// was stored there. With createOnly set, a taken id is a conflict
+	// instead.
+	Put(ctx context.Context, key int, item schema.Item, createOnly bool)
+	// SetStock sets the stock of the item with the given SKU. An unknown
+	// SKU is an error elastic.IsNotFound reports true for.
+	SetStock(ctx context.Context, key int, sku string, stock int)
+	// Wait waits until every write queued is done or ctx is, and returns
+	// the outcomes that are known by then. Nothing may be queued after.
+	Wait(ctx context.Context) map[int]writeOutcome
+}
+
+// writeOutcome is what came of a write queued on a bulkWriter.
+type writeOutcome struct {
+	// ID is the id of the item written, known unless the write failed
+	// before it was assigned one.
+	ID string
+	// Created is set if the write stored a new item.
+	Created bool
+	// Err is why the write failed. Errors about the item itself are
+	// *elastic.Error, so elastic.IsConflict and elastic.IsNotFound tell
+	// taken ids and unknown SKUs apart.
+	Err error
+}
+
+// stockUpdate is a SetStock call waiting for its routing to be looked up.
+type stockUpdate struct {
+	key   int
+	sku   string
+	stock int
+}
+
+// esBulkWriter feeds the store's bulk processor. With routing on, stock
+// updates are held until BULK_BATCH_SIZE of them can have their routings
+// looked up at once. Each write that succeeds is published on the store's
+// events once Wait has its outcome.
+type esBulkWriter struct {
+	store     *esStore
+	collector *bulkCollector
+	// ids and routings of the items put, by key.
+	ids      map[int]string
+	routings map[int]string
+	stock    map[int]bool
+	pending  []stockUpdate
+	// outcomes known before anything was sent, such as unknown SKUs.
+	outcomes map[int]writeOutcome
+}
+
+// Bulk starts a batch of writes fed to the store's bulk processor.
+func (s *esStore) Bulk() bulkWriter {
+	return &esBulkWriter{
+		store:     s,
+		collector: newBulkCollector(s),
+		ids:       map[int]string{},
+		routings:  map[int]string{},
+		stock:     map[int]bool{},
+		outcomes:  map[int]writeOutcome{},
+	}
+}
+
+func (b *esBulkWriter) Put(ctx context.Context, key int, item schema.Item, createOnly bool) {
+	item, id := prepareItem(item)
+	req := elastic.NewBulkIndexRequest().
+		Index(b.store.index).
+		Type("item").
+		Doc(item)
+	if id != "" {
+		req = req.Id(id)
+		if createOnly {
+			req = req.OpType("create")
+		}
+	}
+	if b.store.routing && item.Category != "" {
+		req = req.Routing(item.Category)
+		b.routings[key] = item.Category
+	}
+	b.ids[key] = id
+	b.collector.add(req, key)
+}
+
+func (b *esBulkWriter) SetStock(ctx context.Context, key int, sku string, stock int) {
+	b.ids[key] = sku
+	b.stock[key] = true
+	if !b.store.routing {
+		b.collector.add(b.stockRequest(sku, stock, ""), key)
+		return
+	}
+	b.pending = append(b.pending, stockUpdate{key: key, sku: sku, stock: stock})
+	if len(b.pending) >= b.store.cfg.BulkBatchSize {
+		b.flushStock(ctx)
+	}
+}
+
+func (b *esBulkWriter) stockRequest(sku string, stock int, routing string) elastic.BulkableRequest {
+	update := elastic.NewBulkUpdateRequest().
+		Index(b.store.index).
+		Type("item").
+		Id(sku).
+		Doc(map[string]interface{}{"stock": stock})
+	if routing != "" {
+		update = update.Routing(routing)
+	}
+	return update
+}
+
+// flushStock looks up the routings of the pending stock updates and sends
+// them. SKUs the lookup can't find aren't there to update. If the lookup
+// fails, so do the updates, unless ctx is done, which leaves them out.
+func (b *esBulkWriter) flushStock(ctx context.Context) {
+	if len(b.pending) == 0 {
+		return
+	}
+	skus := make([]string, 0, len(b.pending))
+	for _, u := range b.pending {
+		skus = append(skus, u.sku)
+	}
+	routings, err := b.store.routings(ctx, skus)
+	for _, u := range b.pending {
+		routing, found := routings[u.sku]
+		switch {
+		case err != nil && ctx.Err() != nil:
+		case err != nil:
+			b.outcomes[u.key] = writeOutcome{ID: u.sku, Err: err}
+		case !found:
+			b.outcomes[u.key] = writeOutcome{ID: u.sku, Err: &elastic.Error{Status: http.StatusNotFound, Details: &elastic.ErrorDetails{
+				Type:   "document_missing_exception",
+				Reason: fmt.Sprintf("[item][%s]: document missing", u.sku),
+			}}}
+		default:
+			b.collector.add(b.stockRequest(u.sku, u.stock, routing), u.key)
+		}
+	}
+	b.pending = nil
+}
+
+func (b *esBulkWriter) Wait(ctx context.Context) map[int]writeOutcome {
+	if ctx.Err() == nil {
+		b.flushStock(ctx)
+	}
+	results := b.collector.wait(ctx)
+
+	outcomes := make(map[int]writeOutcome, len(results)+len(b.outcomes))
+	for key, outcome := range b.outcomes {
+		outcomes[key] = outcome
+	}
+	for key, result := range results {
+		outcome := writeOutcome{ID: b.ids[key], Err: result.err}
+		if result.err == nil {
+			outcome.ID = result.item.Id
+			if result.item.Error != nil {
+				outcome.Err = &elastic.Error{Status: result.item.Status, Details: result.item.Error}
+			}
+		}
+		event := itemUpdated
+		if outcome.Err == nil && !b.stock[key] {
+			b.store.rememberRouting(outcome.ID, b.routings[key])
+			if result.item.Result != "updated" {
+				outcome.Created = true
+				event = itemCreated
+			}
+		}
+		outcomes[key] = outcome
+		if outcome.Err == nil {
+			b.store.events.publish(itemEvent{Type: event, ItemID: outcome.ID, RequestID: requestID(ctx)})
+		}
+	}
+	return outcomes
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"gopkg.in/olivere/elastic.v6"
+	"net/http"
+	"strings"
+)
+
+// addTagScript appends params.tag to an item's tags unless it's there
+// already, in which case the item is left alone.
+const addTagScript = `
+if (ctx._source.tags == null) {
+	ctx._source.tags = [params.tag];
+} else if (ctx._source.tags.contains(params.tag)) {
+	ctx.op = 'noop';
+} else {
+	ctx._source.tags.add(params.tag);
+}`
+
+// bulkTagResult is the /api/bulk-tag response body.
+type bulkTagResult struct {
+	Tag string `json:"tag"`
+	// Updated is how many items got the tag. Items that had it already
+	// aren't counted.
+	Updated int64 `json:"updated"`
+	// Conflicts is how many items were skipped because they changed while
+	// being tagged.
+	Conflicts int64 `json:"conflicts,omitempty"`
+}
+
+// bulkTagHandler adds a tag to every item matching name and category, with
+// an update-by-query. name is matched like free text with all its words
+// required, category exactly. With WRITE_REQUIRE_FILTER set, one of them
+// must be given unless confirm=true is passed, so a forgotten param can't
+// tag the whole inventory. The tagged items aren't known one by one, so an
+// itemsChanged event is published on events instead.
+func bulkTagHandler(cfg Config, client *elastic.Client, events *eventBus) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		tags := normalizeTags([]string{r.FormValue("tag")})
+		if len(tags) == 0 {
+			http.Error(w, "tag is required", http.StatusBadRequest)
+			return
+		}
+		result := bulkTagResult{Tag: tags[0]}
+
+		name := strings.TrimSpace(r.FormValue("name"))
+		category := strings.TrimSpace(r.FormValue("category"))
+		if name == "" && category == "" && cfg.WriteRequireFilter && !confirmed(r) {
+			http.Error(w, "this would tag every item, give name or category, or pass confirm=true to go ahead anyway", http.StatusBadRequest)
+			return
+		}
+		// Items that have the tag already needn't be rewritten.
+		query := elastic.NewBoolQuery().MustNot(elastic.NewTermQuery("tags", result.Tag))
+		if name != "" {
+			query = query.Filter(elastic.NewMatchQuery("name", name).Operator("and"))
+		}
+		if category != "" {
+			query = query.Filter(elastic.NewTermQuery("category", category))
+		}
+
+		res, err := client.UpdateByQuery(cfg.IndexName).
+			Type("item").
+			Query(query).
+			Script(elastic.NewScript(addTagScript).Lang("painless").Param("tag", result.Tag)).
+			ProceedOnVersionConflict().
+			Refresh("true").
+			Do(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		result.Updated = res.Updated
+		result.Conflicts = res.VersionConflicts
+		if result.Updated > 0 {
+			events.publish(itemEvent{Type: itemsChanged, RequestID: requestID(r.Context())})
+		}
+		logf(r.Context(), "Tagged %d items %q, %d conflicts\n", result.Updated, result.Tag, result.Conflicts)
+		writeJSON(w, r, http.StatusOK, result)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// updateByQueryES answers update-by-query requests as if updated items were
+// tagged.
+func updateByQueryES(updated int) esHandler {
+	return func(req esRequest) (int, interface{}) {
+		return http.StatusOK, map[string]interface{}{"took": 1, "total": updated, "updated": updated, "version_conflicts": 0}
+	}
+}
+
+func TestBulkTagRequireFilter(t *testing.T) {
+	tests := []struct {
+		query   string
+		require bool
+		status  int
+	}{
+		{"?tag=clearance", true, http.StatusBadRequest},
+		{"?tag=clearance&confirm=true", true, http.StatusOK},
+		{"?tag=clearance&category=cables", true, http.StatusOK},
+		{"?tag=clearance", false, http.StatusOK},
+	}
+	for _, tt := range tests {
+		cfg := testConfig(t)
+		cfg.WriteRequireFilter = tt.require
+		client, es := newFakeES(t, updateByQueryES(3))
+		w := httptest.NewRecorder()
+		bulkTagHandler(cfg, client, nil)(w, httptest.NewRequest("POST", "/api/bulk-tag"+tt.query, nil))
+		if w.Code != tt.status {
+			t.Errorf("bulk-tag%s with WRITE_REQUIRE_FILTER=%v answered %d, want %d: %s", tt.query, tt.require, w.Code, tt.status, w.Body)
+			continue
+		}
+		updates := es.requestsTo("POST", "/_update_by_query")
+		if tt.status == http.StatusBadRequest {
+			if len(updates) > 0 {
+				t.Errorf("bulk-tag%s refused but updated anyway", tt.query)
+			}
+			continue
+		}
+		if len(updates) != 1 || !strings.Contains(w.Body.String(), `"updated":3`) {
+			t.Errorf("bulk-tag%s returned %q after %d updates", tt.query, w.Body, len(updates))
+		}
+	}
+}
+
+func TestBulkTag(t *testing.T) {
+	client, es := newFakeES(t, updateByQueryES(2))
+	events := newEventBus()
+	published := make(chan itemEvent, 1)
+	events.subscribe("test", 1, func(e itemEvent) { published <- e })
+
+	w := httptest.NewRecorder()
+	bulkTagHandler(testConfig(t), client, events)(w, httptest.NewRequest("POST", "/api/bulk-tag?tag=+Clearance&name=usb+cable&category=cables", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("bulk-tag answered %d: %s", w.Code, w.Body)
+	}
+	if body := strings.TrimSpace(w.Body.String()); body != `{"tag":"clearance","updated":2}` {
+		t.Errorf("bulk-tag returned %s", body)
+	}
+
+	updates := es.requestsTo("POST", "/items/item/_update_by_query")
+	if len(updates) != 1 {
+		t.Fatalf("bulk-tag sent %d updates by query", len(updates))
+	}
+	update := updates[0]
+	if update.Query.Get("refresh") != "true" || update.Query.Get("conflicts") != "proceed" {
+		t.Errorf("updated with %v, want a refresh and to proceed on conflicts", update.Query)
+	}
+	// Only the matching items that don't have the tag yet are rewritten.
+	for _, clause := range []string{
+		`"must_not":{"term":{"tags":"clearance"}}`,
+		`{"match":{"name":{"operator":"and","query":"usb cable"}}}`,
+		`{"term":{"category":"cables"}}`,
+		`"params":{"tag":"clearance"}`,
+	} {
+		if !strings.Contains(update.Body, clause) {
+			t.Errorf("update by query %s lacks %s", update.Body, clause)
+		}
+	}
+
+	select {
+	case e := <-published:
+		if e.Type != itemsChanged || e.ItemID != "" {
+			t.Errorf("bulk-tag published %+v", e)
+		}
+	case <-time.After(time.Second):
+		t.Error("bulk-tag published no event")
+	}
+}
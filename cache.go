@@ -0,0 +1,175 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"invento-search/schema"
+	"sync"
+	"time"
+)
+
+// itemCache keeps recently read items in memory, evicting the least
+// recently used ones beyond its size. Entries expire after ttl, which bounds
+// how stale they get through writes this process doesn't see, such as
+// those of other instances. Writes it does see invalidate them straight
+// away, see watch and cachedStore.
+type itemCache struct {
+	size int
+	ttl  time.Duration
+
+	mu      sync.Mutex
+	order   *list.List // of *cacheEntry, most recently used first
+	entries map[string]*list.Element
+	// generation is bumped by every invalidation, so a read that started
+	// before one doesn't cache what it got, see put.
+	generation uint64
+}
+
+type cacheEntry struct {
+	item    schema.Item
+	expires time.Time
+}
+
+func newItemCache(size int, ttl time.Duration) *itemCache {
+	return &itemCache{size: size, ttl: ttl, order: list.New(), entries: map[string]*list.Element{}}
+}
+
+// get returns the cached item with the given id.
+func (c *itemCache) get(id string) (schema.Item, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, found := c.entries[id]
+	if !found {
+		return schema.Item{}, false
+	}
+	entry := el.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		c.order.Remove(el)
+		delete(c.entries, id)
+		return schema.Item{}, false
+	}
+	c.order.MoveToFront(el)
+	return copyItem(entry.item), true
+}
+
+// start returns the generation to put the result of a read with, taken
+// before the read.
+func (c *itemCache) start() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.generation
+}
+
+// put caches item, read when the cache was at generation. Items read
+// before an invalidation may be outdated and aren't cached.
+func (c *itemCache) put(item schema.Item, generation uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation != c.generation {
+		return
+	}
+	entry := &cacheEntry{item: copyItem(item), expires: time.Now().Add(c.ttl)}
+	if el, found := c.entries[item.ID]; found {
+		el.Value = entry
+		c.order.MoveToFront(el)
+		return
+	}
+	c.entries[item.ID] = c.order.PushFront(entry)
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).item.ID)
+	}
+}
+
+// invalidate drops the item with the given id, or every item for "".
+func (c *itemCache) invalidate(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	if id == "" {
+		c.order.Init()
+		c.entries = map[string]*list.Element{}
+		return
+	}
+	if el, found := c.entries[id]; found {
+		c.order.Remove(el)
+		delete(c.entries, id)
+	}
+}
+
+// watch invalidates items as events report them written. Writes by query
+// report no item, so they empty the cache.
+func (c *itemCache) watch(events *eventBus) {
+	events.subscribe("item cache", 1024, func(e itemEvent) {
+		c.invalidate(e.ItemID)
+	})
+}
+
+// cachedStore serves Get and GetMany from cache, and passes everything
+// else on to the ItemStore it wraps. Its own writes invalidate the item
+// before returning, so a read straight after one sees it, events can
+// arrive a moment later.
+type cachedStore struct {
+	ItemStore
+	cache *itemCache
+}
+
+// Get returns the item with the given id, from cache if it's there.
+func (s *cachedStore) Get(ctx context.Context, id string) (schema.Item, error) {
+	if item, found := s.cache.get(id); found {
+		return item, nil
+	}
+	generation := s.cache.start()
+	item, err := s.ItemStore.Get(ctx, id)
+	if err != nil {
+		return schema.Item{}, err
+	}
+	s.cache.put(item, generation)
+	return item, nil
+}
+
+// GetMany returns the items with the given ids in the order given, only
+// fetching the ones that aren't cached.
+func (s *cachedStore) GetMany(ctx context.Context, ids []string) ([]schema.Item, error) {
+	found := map[string]schema.Item{}
+	var missing []string
+	for _, id := range ids {
+		if item, ok := s.cache.get(id); ok {
+			found[id] = item
+		} else {
+			missing = append(missing, id)
+		}
+	}
+	if len(missing) > 0 {
+		generation := s.cache.start()
+		fetched, err := s.ItemStore.GetMany(ctx, missing)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range fetched {
+			s.cache.put(item, generation)
+			found[item.ID] = item
+		}
+	}
+
+	var items []schema.Item
+	for _, id := range ids {
+		if item, ok := found[id]; ok {
+			items = append(items, item)
+		}
+	}
+	return items, nil
+}
+
+// Update updates the item and drops it from cache.
+func (s *cachedStore) Update(ctx context.Context, id string, doc map[string]interface{}, refresh RefreshPolicy) error {
+	defer s.cache.invalidate(id)
+	return s.ItemStore.Update(ctx, id, doc, refresh)
+}
+
+// Delete deletes the item and drops it from cache.
+func (s *cachedStore) Delete(ctx context.Context, id string, refresh RefreshPolicy) (bool, error) {
+	defer s.cache.invalidate(id)
+	return s.ItemStore.Delete(ctx, id, refresh)
+}
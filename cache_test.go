@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"invento-search/schema"
+	"testing"
+	"time"
+)
+
+// countingStore counts the items read through it.
+type countingStore struct {
+	ItemStore
+	reads int
+}
+
+func (s *countingStore) Get(ctx context.Context, id string) (schema.Item, error) {
+	s.reads++
+	return s.ItemStore.Get(ctx, id)
+}
+
+func (s *countingStore) GetMany(ctx context.Context, ids []string) ([]schema.Item, error) {
+	s.reads += len(ids)
+	return s.ItemStore.GetMany(ctx, ids)
+}
+
+func newCachedTestStore(t *testing.T, events *eventBus, size int, ttl time.Duration) (*cachedStore, *countingStore) {
+	t.Helper()
+	backing := &countingStore{ItemStore: newMemoryStore(events)}
+	for _, name := range []string{"Desk", "Chair", "Lamp"} {
+		if _, err := backing.Create(context.Background(), schema.Item{ID: name, Name: name}, RefreshNone); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cache := newItemCache(size, ttl)
+	cache.watch(events)
+	return &cachedStore{ItemStore: backing, cache: cache}, backing
+}
+
+func TestCachedStoreUpdate(t *testing.T) {
+	ctx := context.Background()
+	store, backing := newCachedTestStore(t, newEventBus(), 10, time.Minute)
+
+	for i := 0; i < 3; i++ {
+		if _, err := store.Get(ctx, "Desk"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if backing.reads != 1 {
+		t.Errorf("3 gets read the store %d times, want once", backing.reads)
+	}
+
+	// An edit followed by a page view must show the edit.
+	if err := store.Update(ctx, "Desk", map[string]interface{}{"name": "Standing desk"}, RefreshNone); err != nil {
+		t.Fatal(err)
+	}
+	item, err := store.Get(ctx, "Desk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.Name != "Standing desk" {
+		t.Errorf("got %q after the update", item.Name)
+	}
+
+	if _, err := store.Delete(ctx, "Desk", RefreshNone); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get(ctx, "Desk"); err == nil {
+		t.Error("got the item after deleting it")
+	}
+}
+
+func TestCachedStoreEvents(t *testing.T) {
+	ctx := context.Background()
+	events := newEventBus()
+	store, backing := newCachedTestStore(t, events, 10, time.Minute)
+	items, err := store.GetMany(ctx, []string{"Desk", "Chair"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 2 {
+		t.Fatalf("got %d items, want 2", len(items))
+	}
+	backing.reads = 0
+
+	// Writes by query, like bulk tagging, don't say which items changed.
+	events.publish(itemEvent{Type: itemsChanged})
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, cached := store.cache.get("Chair"); !cached {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the cache kept the items after an itemsChanged event")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := store.GetMany(ctx, []string{"Desk", "Chair"}); err != nil {
+		t.Fatal(err)
+	}
+	if backing.reads != 2 {
+		t.Errorf("read %d items from the store after the event, want 2", backing.reads)
+	}
+}
+
+func TestItemCache(t *testing.T) {
+	cache := newItemCache(2, time.Minute)
+	for _, id := range []string{"a", "b"} {
+		cache.put(schema.Item{ID: id}, cache.start())
+	}
+	cache.get("a")
+	cache.put(schema.Item{ID: "c"}, cache.start())
+	if _, found := cache.get("b"); found {
+		t.Error("the least recently used item wasn't evicted")
+	}
+	if _, found := cache.get("a"); !found {
+		t.Error("a recently used item was evicted")
+	}
+
+	// A read that started before an invalidation may have the old item.
+	generation := cache.start()
+	cache.invalidate("d")
+	cache.put(schema.Item{ID: "d", Name: "old"}, generation)
+	if _, found := cache.get("d"); found {
+		t.Error("an item read before an invalidation was cached")
+	}
+
+	expiring := newItemCache(2, time.Nanosecond)
+	expiring.put(schema.Item{ID: "a"}, expiring.start())
+	time.Sleep(time.Millisecond)
+	if _, found := expiring.get("a"); found {
+		t.Error("an expired item was returned")
+	}
+}
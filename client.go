@@ -0,0 +1,46 @@
+package main
+
+import (
+	"gopkg.in/olivere/elastic.v6"
+	"net"
+	"net/http"
+	"time"
+)
+
+// newElasticClient creates the Elasticsearch client with a transport tuned
+// by the config. The standard library only keeps 2 idle connections per
+// host, which forces new connections under load.
+//
+// It is called once at startup and the client is shared by all handlers, so
+// connections are reused across requests. Every request's outcome is
+// recorded by esBreaker, and requests made for an incoming request carry
+// its id.
+func newElasticClient(cfg Config, esBreaker *breaker) (*elastic.Client, error) {
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   5 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:        cfg.MaxIdleConnsPerHost * 4,
+		MaxIdleConnsPerHost: cfg.MaxIdleConnsPerHost,
+		IdleConnTimeout:     cfg.IdleConnTimeout,
+	}
+	httpClient := &http.Client{
+		Timeout:   cfg.RequestTimeout,
+		Transport: &opaqueIDTransport{next: &breakerTransport{next: transport, breaker: esBreaker}},
+	}
+
+	return elastic.NewClient(
+		elastic.SetURL(cfg.ElasticsearchURL),
+		elastic.SetHttpClient(httpClient),
+	)
+}
+
+// newReadyClient creates a client for waiting on the index to become ready.
+// Elasticsearch holds that request for up to IndexReadyTimeout, which may
+// well be longer than RequestTimeout allows any other request.
+func newReadyClient(cfg Config, esBreaker *breaker) (*elastic.Client, error) {
+	cfg.RequestTimeout += cfg.IndexReadyTimeout
+	return newElasticClient(cfg, esBreaker)
+}
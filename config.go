@@ -0,0 +1,326 @@
+package main
+
+import (
+	"fmt"
+	"invento-search/search"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds the service settings. It is loaded once at startup by
+// LoadConfig and passed to whatever needs it.
+type Config struct {
+	// Port is the HTTP port to listen on.
+	Port string
+
+	// ElasticsearchURL is the cluster to talk to.
+	ElasticsearchURL string
+	// IndexName is the index items are stored in.
+	IndexName string
+	// ArchivedIndexName is the index archived items are moved to.
+	ArchivedIndexName string
+
+	// IndexReadyTimeout is how long startup waits for the index to become
+	// usable.
+	IndexReadyTimeout time.Duration
+
+	// MaxIdleConnsPerHost is how many idle connections are kept per node.
+	MaxIdleConnsPerHost int
+	// IdleConnTimeout is how long idle connections are kept.
+	IdleConnTimeout time.Duration
+	// RequestTimeout bounds every Elasticsearch request.
+	RequestTimeout time.Duration
+	// SearchTimeout bounds the work Elasticsearch does per search, after
+	// which it returns the hits found so far.
+	SearchTimeout time.Duration
+
+	// SlowSearchThreshold is how long a search may take before it's
+	// logged as slow.
+	SlowSearchThreshold time.Duration
+
+	// BreakerThreshold is how many Elasticsearch requests in a row must
+	// fail before pages switch to the maintenance notice.
+	BreakerThreshold int
+	// HealthCheckInterval is how often Elasticsearch is pinged, so the
+	// breaker closes again once it's back.
+	HealthCheckInterval time.Duration
+	// IndexStatsInterval is how often the item count and index size are
+	// logged.
+	IndexStatsInterval time.Duration
+
+	// DefaultPageSize is the number of results returned when a search
+	// doesn't ask for a size.
+	DefaultPageSize int
+	// MaxPageSize caps the size a search can ask for.
+	MaxPageSize int
+
+	// BulkBatchSize is how many actions are sent per bulk request.
+	BulkBatchSize int
+	// BulkWorkers is how many bulk requests the bulk processor has in
+	// flight at once.
+	BulkWorkers int
+	// BulkFlushInterval is how long the bulk processor holds actions
+	// before sending a bulk request that isn't full.
+	BulkFlushInterval time.Duration
+
+	// ItemCacheSize is how many items the pages keep in memory, and
+	// ItemCacheTTL how long each is kept.
+	ItemCacheSize int
+	ItemCacheTTL  time.Duration
+
+	// PopularSearchTerms is how many distinct search terms are counted for
+	// /api/popular-searches.
+	PopularSearchTerms int
+
+	// MapPrecision is the default geohash precision of /api/map clusters,
+	// from 1 (continents) to 12 (centimetres).
+	MapPrecision int
+
+	// LowStockThreshold is the stock level below which items are reported
+	// by /api/low-stock.
+	LowStockThreshold int
+
+	// TemplateDir holds the page templates, the builtin ones are used if
+	// it doesn't exist.
+	TemplateDir string
+
+	// DateFormat is the Go time layout pages show dates in, and TimeZone
+	// the zone they're shown in. Dates are stored in UTC either way.
+	DateFormat string
+	TimeZone   *time.Location
+
+	// PriceCurrency is the ISO 4217 code of the currency prices are in.
+	PriceCurrency string
+
+	// SearchMode is the search mode used when a request doesn't give one.
+	SearchMode search.Mode
+
+	// SearchDefaults are the relevance settings, from the file at
+	// SEARCH_DEFAULTS_FILE or the builtin ones. DefaultPageSize and
+	// SearchBoosts take precedence over its size and boosts.
+	SearchDefaults search.Defaults
+	// SearchBoosts weights the fields free text is matched against.
+	SearchBoosts []search.FieldBoost
+
+	// AdminToken guards the admin endpoints, which are disabled when empty.
+	AdminToken string
+	// AllowReset enables /admin/reset.
+	AllowReset bool
+	// AllowExplain enables /api/search/explain.
+	AllowExplain bool
+	// ExportRequireFilter makes /api/export refuse searches matching every
+	// item, unless confirmed.
+	ExportRequireFilter bool
+	// WriteRequireFilter makes /api/bulk-tag refuse to tag every item, and
+	// /admin/reset refuse to delete the index, unless confirmed.
+	WriteRequireFilter bool
+	// ForcemergeSegments is the number of segments per shard
+	// /admin/forcemerge merges down to by default.
+	ForcemergeSegments int
+
+	// CookieSecret signs the recently viewed items cookie. A random one is
+	// used when empty.
+	CookieSecret string
+
+	// RouteByCategory routes items to shards by category, so items of a
+	// category land on the same shard.
+	RouteByCategory bool
+}
+
+// LoadConfig reads the configuration from the environment and applies
+// defaults. Every invalid setting is reported in the returned error, not
+// just the first.
+func LoadConfig() (Config, error) {
+	env := &envReader{}
+	defaults := env.searchDefaults("SEARCH_DEFAULTS_FILE")
+	cfg := Config{
+		Port:                env.port("PORT", "8080"),
+		ElasticsearchURL:    env.url("ELASTICSEARCH_URL", "http://127.0.0.1:9200"),
+		IndexName:           env.string("INDEX_NAME", "items"),
+		ArchivedIndexName:   env.string("ARCHIVED_INDEX_NAME", "items-archived"),
+		IndexReadyTimeout:   env.duration("INDEX_READY_TIMEOUT", 30*time.Second),
+		MaxIdleConnsPerHost: env.positiveInt("ES_MAX_IDLE_CONNS_PER_HOST", 32),
+		IdleConnTimeout:     env.duration("ES_IDLE_CONN_TIMEOUT", 90*time.Second),
+		RequestTimeout:      env.duration("ES_REQUEST_TIMEOUT", 10*time.Second),
+		SearchTimeout:       env.duration("SEARCH_TIMEOUT", 3*time.Second),
+		SlowSearchThreshold: env.duration("SLOW_SEARCH_THRESHOLD", 500*time.Millisecond),
+		BreakerThreshold:    env.positiveInt("BREAKER_THRESHOLD", 5),
+		HealthCheckInterval: env.duration("HEALTH_CHECK_INTERVAL", 10*time.Second),
+		IndexStatsInterval:  env.duration("INDEX_STATS_INTERVAL", 5*time.Minute),
+		DefaultPageSize:     env.positiveInt("DEFAULT_PAGE_SIZE", defaults.Size),
+		MaxPageSize:         env.positiveInt("MAX_PAGE_SIZE", 1000),
+		BulkBatchSize:       env.positiveInt("BULK_BATCH_SIZE", 500),
+		BulkWorkers:         env.positiveInt("BULK_WORKERS", 2),
+		BulkFlushInterval:   env.duration("BULK_FLUSH_INTERVAL", time.Second),
+		ItemCacheSize:       env.positiveInt("ITEM_CACHE_SIZE", 1000),
+		ItemCacheTTL:        env.duration("ITEM_CACHE_TTL", 30*time.Second),
+		PopularSearchTerms:  env.positiveInt("POPULAR_SEARCH_TERMS", 10000),
+		MapPrecision:        env.positiveInt("MAP_PRECISION", 5),
+		LowStockThreshold:   env.positiveInt("LOW_STOCK_THRESHOLD", 5),
+		TemplateDir:         env.string("TEMPLATE_DIR", "templates"),
+		DateFormat:          env.string("DATE_FORMAT", "2 Jan 2006 15:04 MST"),
+		TimeZone:            env.location("TIME_ZONE", time.UTC),
+		PriceCurrency:       env.string("PRICE_CURRENCY", "USD"),
+		SearchMode:          env.searchMode("SEARCH_MODE", search.ModeDefault),
+		SearchDefaults:      defaults,
+		SearchBoosts:        env.boosts("SEARCH_BOOSTS", defaults.Boosts),
+		AdminToken:          env.string("ADMIN_TOKEN", ""),
+		AllowReset:          env.bool("ALLOW_RESET", false),
+		AllowExplain:        env.bool("ALLOW_EXPLAIN", false),
+		ExportRequireFilter: env.bool("EXPORT_REQUIRE_FILTER", false),
+		WriteRequireFilter:  env.bool("WRITE_REQUIRE_FILTER", true),
+		ForcemergeSegments:  env.positiveInt("FORCEMERGE_SEGMENTS", 1),
+		CookieSecret:        env.string("COOKIE_SECRET", ""),
+		RouteByCategory:     env.bool("ROUTE_BY_CATEGORY", false),
+	}
+
+	if cfg.DefaultPageSize > cfg.MaxPageSize {
+		env.invalid("DEFAULT_PAGE_SIZE (%d) must not be larger than MAX_PAGE_SIZE (%d)", cfg.DefaultPageSize, cfg.MaxPageSize)
+	}
+	if cfg.MapPrecision > 12 {
+		env.invalid("MAP_PRECISION must be from 1 to 12, got %d", cfg.MapPrecision)
+	}
+	if cfg.IndexName == cfg.ArchivedIndexName {
+		env.invalid("INDEX_NAME and ARCHIVED_INDEX_NAME must differ, both are %q", cfg.IndexName)
+	}
+	return cfg, env.err()
+}
+
+// envReader reads typed settings from the environment, collecting the
+// problems it finds along the way.
+type envReader struct {
+	problems []string
+}
+
+func (e *envReader) invalid(format string, args ...interface{}) {
+	e.problems = append(e.problems, fmt.Sprintf(format, args...))
+}
+
+func (e *envReader) err() error {
+	if len(e.problems) == 0 {
+		return nil
+	}
+	return fmt.Errorf("invalid configuration:\n  %s", strings.Join(e.problems, "\n  "))
+}
+
+func (e *envReader) string(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+func (e *envReader) bool(name string, def bool) bool {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		e.invalid("%s must be true or false, got %q", name, v)
+		return def
+	}
+	return b
+}
+
+func (e *envReader) positiveInt(name string, def int) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		e.invalid("%s must be a positive number, got %q", name, v)
+		return def
+	}
+	return n
+}
+
+func (e *envReader) duration(name string, def time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		e.invalid("%s must be a positive duration such as 5s, got %q", name, v)
+		return def
+	}
+	return d
+}
+
+func (e *envReader) location(name string, def *time.Location) *time.Location {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	loc, err := time.LoadLocation(v)
+	if err != nil {
+		e.invalid("%s must be a time zone such as Asia/Jakarta, got %q", name, v)
+		return def
+	}
+	return loc
+}
+
+func (e *envReader) port(name, def string) string {
+	v := e.string(name, def)
+	if n, err := strconv.Atoi(v); err != nil || n < 1 || n > 65535 {
+		e.invalid("%s must be a port number between 1 and 65535, got %q", name, v)
+		return def
+	}
+	return v
+}
+
+func (e *envReader) url(name, def string) string {
+	v := e.string(name, def)
+	if u, err := url.Parse(v); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		e.invalid("%s must be an http or https URL, got %q", name, v)
+		return def
+	}
+	return v
+}
+
+func (e *envReader) boosts(name string, def []search.FieldBoost) []search.FieldBoost {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	boosts, err := search.ParseBoosts(v)
+	if err != nil {
+		e.invalid("%s: %v", name, err)
+		return def
+	}
+	return boosts
+}
+
+// searchDefaults reads the search defaults file at the path in name, the
+// builtin defaults if it isn't set.
+func (e *envReader) searchDefaults(name string) search.Defaults {
+	path := os.Getenv(name)
+	if path == "" {
+		return search.Builtin
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		e.invalid("%s: %v", name, err)
+		return search.Builtin
+	}
+	defaults, err := search.ParseDefaults(data)
+	if err != nil {
+		e.invalid("%s: %s: %v", name, path, err)
+		return search.Builtin
+	}
+	return defaults
+}
+
+func (e *envReader) searchMode(name string, def search.Mode) search.Mode {
+	mode, err := search.ParseMode(os.Getenv(name), def)
+	if err != nil {
+		e.invalid("%s: %v", name, err)
+		return def
+	}
+	return mode
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// itemEventType says what happened to an item.
+type itemEventType string
+
+const (
+	itemCreated itemEventType = "created"
+	itemUpdated itemEventType = "updated"
+	itemDeleted itemEventType = "deleted"
+	// itemsChanged is published after writes by query, such as bulk
+	// tagging or a reset, which may have changed any number of items. It
+	// has no ItemID.
+	itemsChanged itemEventType = "changed"
+)
+
+// itemEvent is published after an item was written.
+type itemEvent struct {
+	Type   itemEventType `json:"type"`
+	ItemID string        `json:"item_id,omitempty"`
+	// RequestID is the id of the request that made the change.
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// eventBus fans item events out to subscribers. Each subscriber has its own
+// buffered queue drained by its own goroutine, so a slow subscriber only
+// drops its own events and never holds up a write.
+type eventBus struct {
+	mu   sync.RWMutex
+	subs []*subscriber
+}
+
+type subscriber struct {
+	name    string
+	events  chan itemEvent
+	dropped uint64
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{}
+}
+
+// subscribe calls handle for every event published from now on, in order,
+// on a goroutine of its own. Up to buffer events are queued while handle
+// is busy, later ones are dropped.
+func (b *eventBus) subscribe(name string, buffer int, handle func(itemEvent)) {
+	sub := &subscriber{name: name, events: make(chan itemEvent, buffer)}
+	go func() {
+		for e := range sub.events {
+			handle(e)
+		}
+	}()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subs = append(b.subs, sub)
+}
+
+// publish queues e for every subscriber without blocking. A nil bus
+// publishes nothing.
+func (b *eventBus) publish(e itemEvent) {
+	if b == nil {
+		return
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, sub := range b.subs {
+		select {
+		case sub.events <- e:
+		default:
+			if n := atomic.AddUint64(&sub.dropped, 1); n == 1 || n%1000 == 0 {
+				fmt.Printf("Subscriber %s is falling behind, dropped %d events\n", sub.name, n)
+			}
+		}
+	}
+}
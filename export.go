@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"invento-search/schema"
+	"net/http"
+)
+
+// exportBatchSize is how many items each scroll page fetches.
+const exportBatchSize = 500
+
+// exportHandler streams every item matching a search as newline-delimited
+// JSON, for backups and bulk exports. With EXPORT_REQUIRE_FILTER set,
+// exporting everything takes confirm=true.
+//
+// Archived items are only exported with includeArchived=true, whatever the
+// mode. An export doesn't say which items were archived, so importing one
+// would otherwise write them back into the items index.
+//
+// Elasticsearch 6 and this client predate point-in-time readers, so
+// esStore pages with a scroll instead, see esStore.Export.
+func exportHandler(cfg Config, store ItemStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		params, err := parseSearchParams(cfg, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		params.IncludeArchived = r.FormValue("includeArchived") == "true"
+		if cfg.ExportRequireFilter {
+			if err := requireFilter(r, params); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		ctx := r.Context()
+		exported := 0
+		var writeErr error
+		enc := json.NewEncoder(w)
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		err = store.Export(ctx, params, func(item schema.Item) error {
+			if writeErr = enc.Encode(item); writeErr != nil {
+				return writeErr
+			}
+			exported++
+			return nil
+		})
+		switch {
+		case writeErr != nil:
+			// The client went away.
+			return
+		case err != nil && exported == 0:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		case err != nil:
+			// Too late for an error status, the client sees the export
+			// stop short.
+			logf(ctx, "Export failed after %d items: %v\n", exported, err)
+			return
+		}
+		logf(ctx, "Exported %d items\n", exported)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"invento-search/schema"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// scrollES answers the first scroll page with one item and the next with
+// none, ending the scroll.
+func scrollES(req esRequest) (int, interface{}) {
+	switch {
+	case req.Method == "DELETE":
+		return http.StatusOK, map[string]interface{}{"succeeded": true}
+	case strings.HasSuffix(req.Path, "/_search/scroll"):
+		res := searchHits(nil)
+		res["_scroll_id"] = "scroll-1"
+		return http.StatusOK, res
+	}
+	res := searchHits(map[string]interface{}{"monitor-24": map[string]interface{}{"name": "Monitor 24"}})
+	res["_scroll_id"] = "scroll-1"
+	return http.StatusOK, res
+}
+
+func TestExportRequireFilter(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.ExportRequireFilter = true
+
+	tests := []struct {
+		query  string
+		status int
+	}{
+		{"", http.StatusBadRequest},
+		{"?inStock=true", http.StatusOK},
+		{"?name=Monitor+24", http.StatusOK},
+		{"?confirm=true", http.StatusOK},
+		{"?confirm=yes", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		client, es := newFakeES(t, scrollES)
+		w := httptest.NewRecorder()
+		exportHandler(cfg, newESStore(cfg, client, nil))(w, httptest.NewRequest("GET", "/api/export"+tt.query, nil))
+		if w.Code != tt.status {
+			t.Errorf("export%s answered %d, want %d: %s", tt.query, w.Code, tt.status, w.Body)
+			continue
+		}
+		searches := es.requestsTo("POST", "/_search")
+		if tt.status == http.StatusBadRequest {
+			if !strings.Contains(w.Body.String(), "confirm=true") {
+				t.Errorf("export%s refused with %q, which doesn't say how to go ahead", tt.query, w.Body)
+			}
+			if len(searches) > 0 {
+				t.Errorf("export%s refused but searched anyway", tt.query)
+			}
+			continue
+		}
+		if len(searches) != 1 || !strings.Contains(w.Body.String(), `"id":"monitor-24"`) {
+			t.Errorf("export%s returned %q after %d searches", tt.query, w.Body, len(searches))
+		}
+	}
+
+	// The guard is off by default.
+	client, _ := newFakeES(t, scrollES)
+	cfg = testConfig(t)
+	w := httptest.NewRecorder()
+	exportHandler(cfg, newESStore(cfg, client, nil))(w, httptest.NewRequest("GET", "/api/export", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("export without EXPORT_REQUIRE_FILTER answered %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestExport(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStore(nil)
+	for _, item := range []schema.Item{
+		{SKU: "CBL-USB", Name: "USB cable", Stock: 3},
+		{SKU: "CBL-HDMI", Name: "HDMI cable", Stock: 1},
+		{SKU: "MON-24", Name: "Monitor 24", Stock: 1},
+	} {
+		if _, err := store.Create(ctx, item, RefreshNone); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Paging is ignored, an export has every match.
+	w := httptest.NewRecorder()
+	exportHandler(testConfig(t), store)(w, httptest.NewRequest("GET", "/api/export?q=cable&size=1", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("export answered %d: %s", w.Code, w.Body)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Errorf("export served %q", ct)
+	}
+	var ids []string
+	for _, line := range strings.Split(strings.TrimSpace(w.Body.String()), "\n") {
+		var item schema.Item
+		if err := json.Unmarshal([]byte(line), &item); err != nil {
+			t.Fatalf("export line %q: %v", line, err)
+		}
+		ids = append(ids, item.ID)
+	}
+	if want := []string{"CBL-HDMI", "CBL-USB"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("exported %v, want %v", ids, want)
+	}
+
+	// What's exported imports again as it was.
+	imported := newMemoryStore(nil)
+	if code, report := postImport(t, imported, "", w.Body.String()); code != http.StatusOK || report.Created != 2 {
+		t.Errorf("importing the export answered %d with %+v", code, report)
+	}
+	if item, err := imported.Get(ctx, "CBL-USB"); err != nil || item.Name != "USB cable" || item.Stock != 3 {
+		t.Errorf("imported %+v (%v)", item, err)
+	}
+}
+
+// archiveES holds monitor-24 in the items index and cable-old in the
+// archive, answering scrolls over either or both.
+func archiveES(cfg Config) esHandler {
+	return func(req esRequest) (int, interface{}) {
+		if req.Method == "DELETE" || strings.HasSuffix(req.Path, "/_search/scroll") {
+			return scrollES(req)
+		}
+		docs := map[string]interface{}{"monitor-24": map[string]interface{}{"name": "Monitor 24"}}
+		if strings.Contains(req.Path, cfg.ArchivedIndexName) {
+			docs["cable-old"] = map[string]interface{}{"name": "Old cable"}
+		}
+		res := searchHits(docs)
+		res["_scroll_id"] = "scroll-1"
+		return http.StatusOK, res
+	}
+}
+
+func TestExportImportKeepsArchive(t *testing.T) {
+	for _, mode := range []string{"", "admin", "storefront"} {
+		cfg := testConfig(t)
+		client, _ := newFakeES(t, archiveES(cfg))
+		w := httptest.NewRecorder()
+		exportHandler(cfg, newESStore(cfg, client, nil))(w, httptest.NewRequest("GET", "/api/export?mode="+mode, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("export with mode %q answered %d: %s", mode, w.Code, w.Body)
+		}
+		if strings.Contains(w.Body.String(), "cable-old") {
+			t.Errorf("export with mode %q has the archived item: %s", mode, w.Body)
+		}
+
+		// Importing it leaves the archived item alone.
+		store := newMemoryStore(nil)
+		if code, report := postImport(t, store, "", w.Body.String()); code != http.StatusOK || report.Created != 1 {
+			t.Errorf("importing the export answered %d with %+v", code, report)
+		}
+		if _, err := store.Get(context.Background(), "cable-old"); err == nil {
+			t.Errorf("importing the export with mode %q un-archived cable-old", mode)
+		}
+	}
+
+	// Asking for it exports the archived item too.
+	cfg := testConfig(t)
+	client, _ := newFakeES(t, archiveES(cfg))
+	w := httptest.NewRecorder()
+	exportHandler(cfg, newESStore(cfg, client, nil))(w, httptest.NewRequest("GET", "/api/export?includeArchived=true", nil))
+	if !strings.Contains(w.Body.String(), "cable-old") {
+		t.Errorf("export with includeArchived=true lacks the archived item: %s", w.Body)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"gopkg.in/olivere/elastic.v6"
+	"invento-search/schema"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	// defaultFacetSize and maxFacetSize bound the values per /api/facets
+	// page.
+	defaultFacetSize = 100
+	maxFacetSize     = 1000
+)
+
+// facetFields are the keyword fields /api/facets lists values of. Other
+// keyword fields, like sku, are unique per item and make no filter.
+var facetFields = []string{"brand", "category", "tags"}
+
+// facetValue is a distinct field value with the number of items having it.
+type facetValue struct {
+	Value string `json:"value"`
+	Count int64  `json:"count"`
+}
+
+// facetResult is the /api/facets response body.
+type facetResult struct {
+	Field  string       `json:"field"`
+	Values []facetValue `json:"values"`
+	// After is passed back as after to get the next page. It's left out
+	// on the last page.
+	After string `json:"after,omitempty"`
+}
+
+// facetsHandler lists the distinct values of a facet field in value order,
+// for filter dropdowns. It pages with a composite aggregation, so fields
+// with many values can be listed in full: size values at a time, each page
+// starting after the last value of the one before.
+func facetsHandler(cfg Config, client *elastic.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		field := r.FormValue("field")
+		if err := checkFacetField(field); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		size := defaultFacetSize
+		if v := r.FormValue("size"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > maxFacetSize {
+				http.Error(w, fmt.Sprintf("size must be a number from 1 to %d", maxFacetSize), http.StatusBadRequest)
+				return
+			}
+			size = n
+		}
+
+		agg := elastic.NewCompositeAggregation().
+			Sources(elastic.NewCompositeAggregationTermsValuesSource("value").Field(field)).
+			Size(size)
+		if after := r.FormValue("after"); after != "" {
+			agg = agg.AggregateAfter(map[string]interface{}{"value": after})
+		}
+		res, err := client.Search().
+			Index(cfg.IndexName).
+			Aggregation("values", agg).
+			Size(0).
+			Do(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		result := facetResult{Field: field, Values: []facetValue{}}
+		if values, found := res.Aggregations.Composite("values"); found {
+			for _, bucket := range values.Buckets {
+				result.Values = append(result.Values, facetValue{Value: fmt.Sprint(bucket.Key["value"]), Count: bucket.DocCount})
+			}
+		}
+		// A short page is the last one.
+		if len(result.Values) == size {
+			result.After = result.Values[size-1].Value
+		}
+		writeJSON(w, r, http.StatusOK, result)
+	}
+}
+
+// checkFacetField reports why field can't be faceted, if it can't.
+func checkFacetField(field string) error {
+	if field == "" {
+		return fmt.Errorf("field is required, one of %s", strings.Join(facetFields, ", "))
+	}
+	for _, f := range facetFields {
+		if f == field {
+			return nil
+		}
+	}
+	properties, err := schema.Properties()
+	if err != nil {
+		return err
+	}
+	property, mapped := properties[field]
+	switch {
+	case !mapped:
+		return fmt.Errorf("unknown field %q, want one of %s", field, strings.Join(facetFields, ", "))
+	case mappingSetting(property, "type") != "keyword":
+		return fmt.Errorf("field %q is not a keyword field, want one of %s", field, strings.Join(facetFields, ", "))
+	}
+	return fmt.Errorf("field %q can't be faceted, want one of %s", field, strings.Join(facetFields, ", "))
+}
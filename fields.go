@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"gopkg.in/olivere/elastic.v6"
+	"invento-search/schema"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+// maxFieldBody caps the body of a single field update.
+const maxFieldBody = 1 << 20
+
+// itemFields maps the json names of the schema.Item fields to their index
+// in the struct, so the field endpoints follow the schema as it changes.
+var itemFields = schemaItemFields()
+
+// immutableItemFields are the item fields that can't be updated on their
+// own, with the reason why.
+var immutableItemFields = map[string]string{
+	"id":            "the id of an item can't be changed",
+	"sku":           "the sku can't be changed, stock updates address the item by it",
+	"created":       "the creation time of an item can't be changed",
+	"suggest_field": "suggestions follow the name, update that instead",
+}
+
+// schemaItemFields lists the fields of schema.Item by their json name.
+func schemaItemFields() map[string]int {
+	fields := map[string]int{}
+	t := reflect.TypeOf(schema.Item{})
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if name != "" && name != "-" {
+			fields[name] = i
+		}
+	}
+	return fields
+}
+
+// itemFieldHandler updates a single field of an item. It serves PATCH
+// /api/items/{id}/{field}, with the new value as the JSON body, such as
+// "A new description" or 12. The field must be one of the schema.Item json
+// names and the value of its type, and the item with the value applied must
+// still validate. It answers with the updated item.
+func itemFieldHandler(store ItemStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/items/"), "/")
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			http.NotFound(w, r)
+			return
+		}
+		id, field := parts[0], parts[1]
+		if r.Method != "PATCH" {
+			w.Header().Set("Allow", "PATCH")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if reason, immutable := immutableItemFields[field]; immutable {
+			http.Error(w, reason, http.StatusBadRequest)
+			return
+		}
+		index, known := itemFields[field]
+		if !known {
+			http.Error(w, fmt.Sprintf("unknown field %q", field), http.StatusBadRequest)
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxFieldBody))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		body = bytes.TrimSpace(body)
+		if len(body) == 0 || bytes.Equal(body, []byte("null")) {
+			http.Error(w, "the body must be the new value as JSON", http.StatusBadRequest)
+			return
+		}
+		fieldType := reflect.TypeOf(schema.Item{}).Field(index).Type
+		value := reflect.New(fieldType)
+		if err := json.Unmarshal(body, value.Interface()); err != nil {
+			http.Error(w, fmt.Sprintf("%s must be %s", field, describeType(fieldType)), http.StatusBadRequest)
+			return
+		}
+
+		item, err := store.Get(r.Context(), id)
+		if elastic.IsNotFound(err) {
+			http.Error(w, "item "+id+" not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		reflect.ValueOf(&item).Elem().Field(index).Set(value.Elem())
+		item.Tags = normalizeTags(item.Tags)
+		if msg, invalid := validateItem(item)[field]; invalid {
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+
+		doc := map[string]interface{}{field: reflect.ValueOf(item).Field(index).Interface()}
+		if field == "name" {
+			// Keep autocomplete in step with the new name.
+			doc["suggest_field"] = map[string]interface{}{"input": []string{item.Name}}
+		}
+		err = store.Update(r.Context(), id, doc, RefreshWaitFor)
+		if elastic.IsStatusCode(err, http.StatusBadRequest) {
+			// Values the mapping can't take, like a malformed location.
+			http.Error(w, esErrorReason(err), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		logf(r.Context(), "Updated %s of item %q\n", field, id)
+		writeJSON(w, r, http.StatusOK, item)
+	}
+}
+
+// describeType names the JSON values a field of type t takes, for errors.
+func describeType(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.String:
+		return "a string"
+	case reflect.Int, reflect.Int64:
+		return "a whole number"
+	case reflect.Float64:
+		return "a number"
+	case reflect.Slice:
+		return "a list of " + strings.TrimPrefix(describeType(t.Elem()), "a ") + "s"
+	}
+	return "a " + t.String()
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"invento-search/schema"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// updateRecorder keeps the partial update documents written through it.
+type updateRecorder struct {
+	ItemStore
+	docs []map[string]interface{}
+}
+
+func (s *updateRecorder) Update(ctx context.Context, id string, doc map[string]interface{}, refresh RefreshPolicy) error {
+	s.docs = append(s.docs, doc)
+	return s.ItemStore.Update(ctx, id, doc, refresh)
+}
+
+func TestItemFieldName(t *testing.T) {
+	store := &updateRecorder{ItemStore: newMemoryStore(nil)}
+	if _, err := store.Create(context.Background(), schema.Item{ID: "monitor-24", Name: "Monitor 24", Stock: 1}, RefreshNone); err != nil {
+		t.Fatal(err)
+	}
+	patch := func(field, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		itemFieldHandler(store)(w, httptest.NewRequest("PATCH", "/api/items/monitor-24/"+field, strings.NewReader(body)))
+		return w
+	}
+
+	if w := patch("name", `"Monitor 24 Pro"`); w.Code != http.StatusOK {
+		t.Fatalf("renaming answered %d: %s", w.Code, w.Body)
+	}
+	want := []map[string]interface{}{{
+		"name":          "Monitor 24 Pro",
+		"suggest_field": map[string]interface{}{"input": []string{"Monitor 24 Pro"}},
+	}}
+	if !reflect.DeepEqual(store.docs, want) {
+		t.Errorf("renaming updated %v, want %v", store.docs, want)
+	}
+
+	if w := patch("suggest_field", `{"input":["Monitor"]}`); w.Code != http.StatusBadRequest {
+		t.Errorf("updating suggest_field answered %d, want 400", w.Code)
+	}
+	if w := patch("stock", `"lots"`); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "stock must be a whole number") {
+		t.Errorf("updating stock with a string answered %d: %s", w.Code, w.Body)
+	}
+	if len(store.docs) != 1 {
+		t.Errorf("invalid updates were written: %v", store.docs[1:])
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"invento-search/schema"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// itemEdit is an edit form submission applied to an item.
+type itemEdit struct {
+	// Item is the item with the submitted values applied.
+	Item schema.Item
+	// Doc holds only the submitted fields, as a partial update document.
+	Doc map[string]interface{}
+	// Errors maps form fields to what's wrong with them.
+	Errors map[string]string
+	// Values holds the submitted text of each field, so the form can be
+	// shown again as it was filled in.
+	Values map[string]string
+}
+
+// applyItemForm applies the submitted item fields in form to item. Fields
+// missing from the form are left as they are.
+func applyItemForm(form url.Values, item schema.Item) itemEdit {
+	edit := itemEdit{Item: item, Doc: map[string]interface{}{}, Errors: map[string]string{}, Values: map[string]string{}}
+	submitted := func(field string) (string, bool) {
+		values, ok := form[field]
+		if !ok || len(values) == 0 {
+			return "", false
+		}
+		v := strings.TrimSpace(values[0])
+		edit.Values[field] = v
+		return v, true
+	}
+
+	if v, ok := submitted("name"); ok {
+		edit.Item.Name = v
+		edit.Doc["name"] = v
+		// Keep autocomplete in step with the new name.
+		edit.Doc["suggest_field"] = map[string]interface{}{"input": []string{v}}
+	}
+	if v, ok := submitted("description"); ok {
+		edit.Item.Description = v
+		edit.Doc["description"] = v
+	}
+	if v, ok := submitted("notes"); ok {
+		edit.Item.Notes = v
+		edit.Doc["notes"] = v
+	}
+	if v, ok := submitted("brand"); ok {
+		edit.Item.Brand = v
+		edit.Doc["brand"] = v
+	}
+	if v, ok := submitted("category"); ok {
+		edit.Item.Category = v
+		edit.Doc["category"] = v
+	}
+	if v, ok := submitted("tags"); ok {
+		edit.Item.Tags = normalizeTags(strings.Split(v, ","))
+		edit.Doc["tags"] = edit.Item.Tags
+	}
+	if v, ok := submitted("stock"); ok {
+		stock, err := strconv.Atoi(v)
+		switch {
+		case v == "":
+			edit.Errors["stock"] = "Stock is required"
+		case err != nil:
+			edit.Errors["stock"] = "Stock must be a whole number"
+		default:
+			edit.Item.Stock = stock
+			edit.Doc["stock"] = stock
+		}
+	}
+	if v, ok := submitted("price"); ok {
+		// ParseFloat takes "NaN" and "Inf", which aren't prices.
+		price, err := strconv.ParseFloat(v, 64)
+		switch {
+		case v == "":
+			edit.Errors["price"] = "Price is required"
+		case err != nil || math.IsNaN(price) || math.IsInf(price, 0):
+			edit.Errors["price"] = "Price must be a number"
+		default:
+			edit.Item.Price = price
+			edit.Doc["price"] = price
+		}
+	}
+
+	for field, msg := range validateItem(edit.Item) {
+		if _, ok := edit.Errors[field]; !ok {
+			edit.Errors[field] = msg
+		}
+	}
+	return edit
+}
+
+// normalizeTags trims and lowercases tags, dropping empty and repeated
+// ones, so "Black" and " black" end up as one tag. The order is kept.
+func normalizeTags(tags []string) []string {
+	var out []string
+	seen := map[string]bool{}
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		out = append(out, tag)
+	}
+	return out
+}
+
+// validateItem checks an item is fit to be stored.
+func validateItem(item schema.Item) map[string]string {
+	errs := map[string]string{}
+	if item.Name == "" {
+		errs["name"] = "Name is required"
+	}
+	if item.Stock < 0 {
+		errs["stock"] = "Stock can't be negative"
+	}
+	if item.Price < 0 {
+		errs["price"] = "Price can't be negative"
+	}
+	return errs
+}
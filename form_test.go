@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"gopkg.in/olivere/elastic.v6"
+	"invento-search/schema"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestApplyItemFormName(t *testing.T) {
+	item := schema.Item{Name: "Monitor 24", Description: "Full HD", Stock: 1}
+
+	edit := applyItemForm(url.Values{"name": {" Monitor 24 Pro "}}, item)
+	if len(edit.Errors) > 0 {
+		t.Fatalf("edit failed: %v", edit.Errors)
+	}
+	want := map[string]interface{}{
+		"name":          "Monitor 24 Pro",
+		"suggest_field": map[string]interface{}{"input": []string{"Monitor 24 Pro"}},
+	}
+	if !reflect.DeepEqual(edit.Doc, want) {
+		t.Errorf("renaming updates %v, want %v", edit.Doc, want)
+	}
+
+	// Suggestions only change with the name.
+	edit = applyItemForm(url.Values{"description": {"4K"}}, item)
+	if _, found := edit.Doc["suggest_field"]; found {
+		t.Errorf("editing the description updates %v, want suggest_field left alone", edit.Doc)
+	}
+}
+
+func TestNormalizeTags(t *testing.T) {
+	for _, tt := range []struct {
+		tags []string
+		want []string
+	}{
+		{[]string{"Black", " black", "BLACK "}, []string{"black"}},
+		{[]string{" Office", "", "  ", "wood", "office"}, []string{"office", "wood"}},
+		{[]string{"Wood", "Office"}, []string{"wood", "office"}},
+		{nil, nil},
+		{[]string{" ", ""}, nil},
+	} {
+		if got := normalizeTags(tt.tags); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("normalizeTags(%q) = %q, want %q", tt.tags, got, tt.want)
+		}
+	}
+
+	// The form takes a comma-separated list.
+	edit := applyItemForm(url.Values{"tags": {"Office, wood,,OFFICE , "}}, schema.Item{Name: "Desk"})
+	if want := []string{"office", "wood"}; !reflect.DeepEqual(edit.Doc["tags"], want) {
+		t.Errorf("form tags updated to %q, want %q", edit.Doc["tags"], want)
+	}
+
+	// Items stored any other way, such as imports, are normalized too.
+	store := newMemoryStore(nil)
+	id, err := store.Create(context.Background(), schema.Item{Name: "Desk", Tags: []string{"Office", " office", ""}}, RefreshNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item, err := store.Get(context.Background(), id); err != nil || !reflect.DeepEqual(item.Tags, []string{"office"}) {
+		t.Errorf("stored tags %q (%v), want [office]", item.Tags, err)
+	}
+}
+
+// suggestES keeps documents, applying partial updates the way
+// Elasticsearch does: objects are merged field by field, anything else,
+// arrays included, is replaced. It answers completion suggestions on
+// suggest_field from them.
+type suggestES struct {
+	docs map[string]map[string]interface{}
+}
+
+func (es *suggestES) handle(req esRequest) (int, interface{}) {
+	id := strings.TrimSuffix(strings.TrimPrefix(req.Path, "/items/item/"), "/_update")
+	ack := map[string]interface{}{"_index": "items", "_type": "item", "_id": id, "_version": 1, "result": "updated"}
+	switch {
+	case strings.HasSuffix(req.Path, "/_search"):
+		var body struct {
+			Suggest map[string]struct {
+				Prefix string `json:"prefix"`
+			} `json:"suggest"`
+		}
+		json.Unmarshal([]byte(req.Body), &body)
+		suggest := map[string]interface{}{}
+		for name, s := range body.Suggest {
+			options := []map[string]interface{}{}
+			for id, doc := range es.docs {
+				for _, input := range suggestInputs(doc) {
+					if strings.HasPrefix(strings.ToLower(input), strings.ToLower(s.Prefix)) {
+						options = append(options, map[string]interface{}{"text": input, "_index": "items", "_type": "item", "_id": id, "_score": 1})
+					}
+				}
+			}
+			suggest[name] = []map[string]interface{}{{"text": s.Prefix, "offset": 0, "length": len(s.Prefix), "options": options}}
+		}
+		res := searchHits(nil)
+		res["suggest"] = suggest
+		return http.StatusOK, res
+	case req.Method == "PUT":
+		var doc map[string]interface{}
+		json.Unmarshal([]byte(req.Body), &doc)
+		es.docs[id] = doc
+		ack["result"] = "created"
+		return http.StatusCreated, ack
+	case strings.HasSuffix(req.Path, "/_update"):
+		var update struct {
+			Doc map[string]interface{} `json:"doc"`
+		}
+		json.Unmarshal([]byte(req.Body), &update)
+		es.docs[id] = mergeDoc(es.docs[id], update.Doc)
+		return http.StatusOK, ack
+	case req.Method == "GET":
+		return http.StatusOK, map[string]interface{}{"_index": "items", "_type": "item", "_id": id, "found": true, "_source": es.docs[id]}
+	}
+	return http.StatusBadRequest, map[string]interface{}{}
+}
+
+// mergeDoc merges update into doc like an Elasticsearch partial update.
+func mergeDoc(doc, update map[string]interface{}) map[string]interface{} {
+	merged := map[string]interface{}{}
+	for k, v := range doc {
+		merged[k] = v
+	}
+	for k, v := range update {
+		current, isObject := merged[k].(map[string]interface{})
+		if object, ok := v.(map[string]interface{}); ok && isObject {
+			v = mergeDoc(current, object)
+		}
+		merged[k] = v
+	}
+	return merged
+}
+
+// suggestInputs returns the completion inputs of a document, which may be
+// a string or a list of them.
+func suggestInputs(doc map[string]interface{}) []string {
+	field, _ := doc["suggest_field"].(map[string]interface{})
+	switch input := field["input"].(type) {
+	case string:
+		return []string{input}
+	case []interface{}:
+		var inputs []string
+		for _, v := range input {
+			if s, ok := v.(string); ok {
+				inputs = append(inputs, s)
+			}
+		}
+		return inputs
+	}
+	return nil
+}
+
+// suggestNames returns the completions of prefix on suggest_field.
+func suggestNames(t *testing.T, client *elastic.Client, prefix string) []string {
+	t.Helper()
+	res, err := client.Search("items").
+		Suggester(elastic.NewCompletionSuggester("name").Field("suggest_field").Prefix(prefix)).
+		Do(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, s := range res.Suggest["name"] {
+		for _, option := range s.Options {
+			names = append(names, option.Text)
+		}
+	}
+	return names
+}
+
+func TestRenameSuggestions(t *testing.T) {
+	es := &suggestES{docs: map[string]map[string]interface{}{}}
+	client, _ := newFakeES(t, es.handle)
+	store := newESStore(testConfig(t), client, nil)
+	site := newTestPages(t, store)
+
+	if _, err := store.Create(context.Background(), schema.Item{SKU: "MON-24", Name: "Monitor 24", Stock: 1}, RefreshNone); err != nil {
+		t.Fatal(err)
+	}
+	if names := suggestNames(t, client, "mon"); !reflect.DeepEqual(names, []string{"Monitor 24"}) {
+		t.Fatalf("mon suggests %v before renaming", names)
+	}
+
+	// Renaming on the edit page replaces the suggestion.
+	if w := postForm(site.edit, "/edit/?id=MON-24", url.Values{"name": {"Display 24"}}); w.Code != http.StatusSeeOther {
+		t.Fatalf("edit answered %d: %s", w.Code, w.Body)
+	}
+	if names := suggestNames(t, client, "mon"); len(names) > 0 {
+		t.Errorf("mon still suggests %v after renaming", names)
+	}
+	if names := suggestNames(t, client, "dis"); !reflect.DeepEqual(names, []string{"Display 24"}) {
+		t.Errorf("dis suggests %v after renaming, want [Display 24]", names)
+	}
+
+	// So does renaming through the field endpoint.
+	w := httptest.NewRecorder()
+	itemFieldHandler(store)(w, httptest.NewRequest("PATCH", "/api/items/MON-24/name", strings.NewReader(`"Screen 24"`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("renaming answered %d: %s", w.Code, w.Body)
+	}
+	if names := suggestNames(t, client, "dis"); len(names) > 0 {
+		t.Errorf("dis still suggests %v after renaming again", names)
+	}
+	if inputs := suggestInputs(es.docs["MON-24"]); !reflect.DeepEqual(inputs, []string{"Screen 24"}) {
+		t.Errorf("suggest_field has the inputs %v, want just [Screen 24]", inputs)
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+// readiness tracks whether the index is ready to serve traffic.
+type readiness struct {
+	ready atomic.Bool
+}
+
+func (h *readiness) setReady()     { h.ready.Store(true) }
+func (h *readiness) isReady() bool { return h.ready.Load() }
+
+// healthStatus is the /healthz response body.
+type healthStatus struct {
+	Ready bool `json:"ready"`
+	// Breaker shows whether Elasticsearch is currently reachable.
+	Breaker breakerState `json:"breaker"`
+}
+
+// healthzHandler reports 200 once the index is ready and 503 before. An
+// open breaker doesn't fail the check, the site stays up and serves the
+// maintenance page.
+func healthzHandler(health *readiness, esBreaker *breaker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status := healthStatus{Ready: health.isReady(), Breaker: esBreaker.state()}
+		if !status.Ready {
+			writeJSON(w, r, http.StatusServiceUnavailable, status)
+			return
+		}
+		writeJSON(w, r, http.StatusOK, status)
+	}
+}
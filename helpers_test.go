@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"gopkg.in/olivere/elastic.v6"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// esRequest is a request the fake Elasticsearch got.
+type esRequest struct {
+	Method string
+	Path   string
+	Query  url.Values
+	Body   string
+}
+
+// fakeES stands in for an Elasticsearch cluster in tests, answering every
+// request with its handler and recording them.
+type fakeES struct {
+	mu       sync.Mutex
+	requests []esRequest
+}
+
+// esHandler answers a request to the fake Elasticsearch. It returns the
+// status and the response body, marshaled to JSON unless it's a string.
+type esHandler func(req esRequest) (int, interface{})
+
+// newFakeES starts a fake Elasticsearch answering with handler, and
+// returns a client for it.
+func newFakeES(t *testing.T, handler esHandler) (*elastic.Client, *fakeES) {
+	t.Helper()
+	es := &fakeES{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		req := esRequest{Method: r.Method, Path: r.URL.Path, Query: r.URL.Query(), Body: string(body)}
+		es.mu.Lock()
+		es.requests = append(es.requests, req)
+		es.mu.Unlock()
+
+		status, res := handler(req)
+		raw, ok := res.(string)
+		if !ok {
+			b, err := json.Marshal(res)
+			if err != nil {
+				t.Errorf("marshaling the response to %s %s: %v", req.Method, req.Path, err)
+			}
+			raw = string(b)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		io.WriteString(w, raw)
+	}))
+	t.Cleanup(server.Close)
+
+	client, err := elastic.NewClient(elastic.SetURL(server.URL), elastic.SetSniff(false), elastic.SetHealthcheck(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, es
+}
+
+// requestsTo returns the requests made to paths ending in suffix.
+func (es *fakeES) requestsTo(method, suffix string) []esRequest {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	var found []esRequest
+	for _, req := range es.requests {
+		if req.Method == method && strings.HasSuffix(req.Path, suffix) {
+			found = append(found, req)
+		}
+	}
+	return found
+}
+
+// searchHits is an Elasticsearch search response with the given documents
+// as hits, by id.
+func searchHits(docs map[string]interface{}) map[string]interface{} {
+	hits := []map[string]interface{}{}
+	for id, doc := range docs {
+		hits = append(hits, map[string]interface{}{"_index": "items", "_type": "item", "_id": id, "_source": doc})
+	}
+	return map[string]interface{}{
+		"took":      1,
+		"timed_out": false,
+		"_shards":   map[string]int{"total": 1, "successful": 1},
+		"hits":      map[string]interface{}{"total": len(hits), "hits": hits},
+	}
+}
+
+// esNotFound is the body Elasticsearch answers a get of a missing document
+// with.
+func esNotFound(id string) map[string]interface{} {
+	return map[string]interface{}{"_index": "items", "_type": "item", "_id": id, "found": false}
+}
+
+// testConfig returns the default configuration.
+func testConfig(t *testing.T) Config {
+	t.Helper()
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"gopkg.in/olivere/elastic.v6"
+	"invento-search/schema"
+	"net/http"
+)
+
+// maxImportLine caps the size of a single item in an import.
+const maxImportLine = 1 << 20
+
+// importFailure is an import line that couldn't be stored.
+type importFailure struct {
+	Line   int    `json:"line"`
+	ID     string `json:"id,omitempty"`
+	Reason string `json:"reason"`
+}
+
+// importReport is the /api/import response body.
+type importReport struct {
+	Created int `json:"created"`
+	Updated int `json:"updated"`
+	// Skipped counts the items left alone because their id was taken,
+	// with onConflict=skip.
+	Skipped int             `json:"skipped"`
+	Failed  []importFailure `json:"failed"`
+	// Aborted says why the import stopped early, if it did. Pending then
+	// counts the items queued whose result didn't come back in time, they
+	// may still be stored. Lines not read by then aren't counted.
+	Aborted string `json:"aborted,omitempty"`
+	Pending int    `json:"pending,omitempty"`
+}
+
+// importHandler stores the items in a newline-delimited JSON body, one per
+// line, as written by /api/export. Items are stored under their id, or
+// else their SKU. With onConflict=overwrite, the default, they replace
+// what was stored under it. With onConflict=skip, they're only created,
+// and items whose id is taken are skipped. Either way an export can be
+// imported again. Items are written in bulk, see ItemStore.Bulk, and the
+// store is refreshed once all are confirmed.
+//
+// If the client goes away or the request's deadline passes, no further
+// items are queued and the report covers what was confirmed so far.
+func importHandler(store ItemStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var create bool
+		switch r.FormValue("onConflict") {
+		case "", "overwrite":
+		case "skip":
+			create = true
+		default:
+			http.Error(w, "onConflict must be skip or overwrite", http.StatusBadRequest)
+			return
+		}
+
+		report := importReport{Failed: []importFailure{}}
+		ctx := r.Context()
+		// Writes are keyed by line.
+		writer := store.Bulk()
+		queued := map[int]bool{}
+		scanner := bufio.NewScanner(r.Body)
+		scanner.Buffer(make([]byte, 0, 64*1024), maxImportLine)
+		line := 0
+		for ctx.Err() == nil && scanner.Scan() {
+			line++
+			if len(scanner.Bytes()) == 0 {
+				continue
+			}
+			var item schema.Item
+			if err := json.Unmarshal(scanner.Bytes(), &item); err != nil {
+				report.Failed = append(report.Failed, importFailure{Line: line, Reason: err.Error()})
+				continue
+			}
+			queued[line] = true
+			writer.Put(ctx, line, item, create)
+		}
+		if err := scanner.Err(); err != nil {
+			// Stop at a line that's too long or a broken body, but report
+			// on what was queued before.
+			report.Failed = append(report.Failed, importFailure{Line: line + 1, Reason: err.Error()})
+		}
+		outcomes := writer.Wait(ctx)
+
+		for l := 1; l <= line; l++ {
+			if !queued[l] {
+				continue
+			}
+			outcome, confirmed := outcomes[l]
+			switch {
+			case !confirmed:
+				report.Pending++
+			case create && elastic.IsConflict(outcome.Err):
+				report.Skipped++
+			case outcome.Err != nil:
+				report.Failed = append(report.Failed, importFailure{Line: l, ID: outcome.ID, Reason: esErrorReason(outcome.Err)})
+			case outcome.Created:
+				report.Created++
+			default:
+				report.Updated++
+			}
+		}
+
+		if report.Pending > 0 || ctx.Err() != nil {
+			// The periodic refresh picks up what was stored.
+			report.Aborted = ctx.Err().Error()
+			logf(ctx, "Import aborted (%s): %d created, %d updated, %d pending\n", report.Aborted, report.Created, report.Updated, report.Pending)
+			writeJSON(w, r, http.StatusServiceUnavailable, report)
+			return
+		}
+		if report.Created+report.Updated > 0 {
+			if err := store.Refresh(ctx); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		logf(ctx, "Import: %d created, %d updated, %d skipped, %d failed\n", report.Created, report.Updated, report.Skipped, len(report.Failed))
+		writeJSON(w, r, http.StatusOK, report)
+	}
+}
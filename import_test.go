@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"invento-search/schema"
+	"invento-search/search"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// postImport posts body to the import handler of store and decodes the
+// report.
+func postImport(t *testing.T, store ItemStore, query, body string) (int, importReport) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	importHandler(store)(w, httptest.NewRequest("POST", "/api/import"+query, strings.NewReader(body)))
+	var report importReport
+	if w.Code == http.StatusOK || w.Code == http.StatusServiceUnavailable {
+		if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+			t.Fatalf("import answered %d with %q: %v", w.Code, w.Body, err)
+		}
+	}
+	return w.Code, report
+}
+
+func TestImport(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStore(nil)
+	if _, err := store.Create(ctx, schema.Item{ID: "monitor-24", Name: "Monitor 24", Stock: 1}, RefreshNone); err != nil {
+		t.Fatal(err)
+	}
+	body := `{"id":"monitor-24","name":"Monitor 24 Pro","stock":3}
+
+{"sku":"CBL-USB","name":"USB cable","stock":10}
+not json
+`
+
+	code, report := postImport(t, store, "?onConflict=skip", body)
+	if code != http.StatusOK {
+		t.Fatalf("import answered %d", code)
+	}
+	if report.Created != 1 || report.Updated != 0 || report.Skipped != 1 {
+		t.Errorf("import with onConflict=skip reported %+v, want 1 created and 1 skipped", report)
+	}
+	if len(report.Failed) != 1 || report.Failed[0].Line != 4 {
+		t.Errorf("import failed %+v, want line 4", report.Failed)
+	}
+	if item, err := store.Get(ctx, "monitor-24"); err != nil || item.Name != "Monitor 24" {
+		t.Errorf("skipped item is %+v (%v), want it unchanged", item, err)
+	}
+	if item, err := store.Get(ctx, "CBL-USB"); err != nil || item.Stock != 10 {
+		t.Errorf("item without id is %+v (%v), want it stored under its SKU", item, err)
+	}
+
+	code, report = postImport(t, store, "", body)
+	if code != http.StatusOK {
+		t.Fatalf("import answered %d", code)
+	}
+	if report.Created != 0 || report.Updated != 2 || report.Skipped != 0 {
+		t.Errorf("import with overwrite reported %+v, want 2 updated", report)
+	}
+	if item, err := store.Get(ctx, "monitor-24"); err != nil || item.Name != "Monitor 24 Pro" {
+		t.Errorf("overwritten item is %+v (%v)", item, err)
+	}
+
+	if code, _ := postImport(t, store, "?onConflict=merge", body); code != http.StatusBadRequest {
+		t.Errorf("import with onConflict=merge answered %d, want 400", code)
+	}
+}
+
+// cancellingReader hands out one line per Read and cancels once it handed
+// out after of them, like a client going away mid-upload.
+type cancellingReader struct {
+	lines  []string
+	after  int
+	cancel context.CancelFunc
+}
+
+func (r *cancellingReader) Read(p []byte) (int, error) {
+	if len(r.lines) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, r.lines[0]+"\n")
+	r.lines = r.lines[1:]
+	if r.after--; r.after == 0 {
+		r.cancel()
+	}
+	return n, nil
+}
+
+func TestImportCancelled(t *testing.T) {
+	store := newMemoryStore(nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	body := &cancellingReader{after: 2, cancel: cancel, lines: []string{
+		`{"sku":"MON-24","name":"Monitor 24"}`,
+		`{"sku":"CBL-USB","name":"USB cable"}`,
+		`{"sku":"KBD-01","name":"Keyboard"}`,
+		`{"sku":"MSE-01","name":"Mouse"}`,
+	}}
+
+	w := httptest.NewRecorder()
+	importHandler(store)(w, httptest.NewRequest("POST", "/api/import", body).WithContext(ctx))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("cancelled import answered %d: %s", w.Code, w.Body)
+	}
+	var report importReport
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Aborted != context.Canceled.Error() || report.Created != 2 || report.Pending != 0 {
+		t.Errorf("cancelled import reported %+v, want 2 created and aborted", report)
+	}
+	// Nothing after the cancellation is stored.
+	res, err := store.Search(context.Background(), search.Params{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Total != 2 {
+		t.Errorf("%d items stored after cancelling, want 2", res.Total)
+	}
+}
+
+// bulkES answers bulk requests as an index already holding the items with
+// the ids in existing would, and refreshes.
+func bulkES(existing ...string) esHandler {
+	return func(req esRequest) (int, interface{}) {
+		if !strings.HasSuffix(req.Path, "/_bulk") {
+			return http.StatusOK, map[string]interface{}{"_shards": map[string]int{"total": 1, "successful": 1}}
+		}
+		var items []map[string]interface{}
+		lines := strings.Split(strings.TrimSpace(req.Body), "\n")
+		for i := 0; i < len(lines); i += 2 {
+			var action map[string]map[string]interface{}
+			json.Unmarshal([]byte(lines[i]), &action)
+			for op, meta := range action {
+				id, _ := meta["_id"].(string)
+				item := map[string]interface{}{"_index": "items", "_type": "item", "_id": id, "status": http.StatusCreated, "result": "created"}
+				switch {
+				case containsString(existing, id) && op == "create":
+					item["status"] = http.StatusConflict
+					item["error"] = map[string]interface{}{
+						"type":   "version_conflict_engine_exception",
+						"reason": "[item][" + id + "]: version conflict, document already exists",
+					}
+				case containsString(existing, id):
+					item["status"], item["result"] = http.StatusOK, "updated"
+				}
+				items = append(items, map[string]interface{}{op: item})
+			}
+		}
+		return http.StatusOK, map[string]interface{}{"took": 1, "items": items}
+	}
+}
+
+func TestImportOnConflict(t *testing.T) {
+	body := `{"id":"monitor-24","name":"Monitor 24"}
+{"sku":"CBL-USB","name":"USB cable"}
+`
+	for _, tt := range []struct {
+		query   string
+		op      string
+		created int
+		updated int
+		skipped int
+	}{
+		{"?onConflict=skip", "create", 1, 0, 1},
+		{"?onConflict=overwrite", "index", 1, 1, 0},
+		{"", "index", 1, 1, 0},
+	} {
+		cfg := testConfig(t)
+		client, es := newFakeES(t, bulkES("monitor-24"))
+		store := newESStore(cfg, client, nil)
+		if err := store.StartBulk(context.Background(), 10, 1, 10*time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+
+		code, report := postImport(t, store, tt.query, body)
+		store.Close()
+		if code != http.StatusOK {
+			t.Errorf("import%s answered %d", tt.query, code)
+			continue
+		}
+		if report.Created != tt.created || report.Updated != tt.updated || report.Skipped != tt.skipped || len(report.Failed) > 0 {
+			t.Errorf("import%s reported %+v, want %d created, %d updated and %d skipped", tt.query, report, tt.created, tt.updated, tt.skipped)
+		}
+		bulks := es.requestsTo("POST", "/_bulk")
+		if len(bulks) != 1 {
+			t.Errorf("import%s sent %d bulks, want 1", tt.query, len(bulks))
+			continue
+		}
+		for _, id := range []string{"monitor-24", "CBL-USB"} {
+			if action := `{"` + tt.op + `":{"_index":"` + cfg.IndexName + `","_id":"` + id + `"`; !strings.Contains(bulks[0].Body, action) {
+				t.Errorf("import%s sent %s, want %s for %s", tt.query, bulks[0].Body, tt.op, id)
+			}
+		}
+		if refreshes := es.requestsTo("POST", "/_refresh"); len(refreshes) != 1 {
+			t.Errorf("import%s refreshed %d times, want once", tt.query, len(refreshes))
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"golang.org/x/sync/errgroup"
+	"gopkg.in/olivere/elastic.v6"
+	"invento-search/schema"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// seedItems is the sample inventory loaded into a freshly created index.
+var seedItems = []schema.Item{
+	{Name: "pedestal", SKU: "PED-001", Description: "3-tier white-colored pedestal.", Stock: 1},
+	{Name: "desk", SKU: "DSK-001", Description: "Black wooden desk.", Stock: 15},
+	{Name: "monitor", SKU: "LG-MON-01", Brand: "LG", Description: "LG monitor complete with cable.", Stock: 2},
+	{Name: "monitor", SKU: "SAM-MON-01", Brand: "Samsung", Description: "Samsung monitor complete with cable.", Stock: 2},
+	{Name: "monitor", SKU: "APL-MON-01", Brand: "Apple", Description: "Apple monitor complete with cable.", Stock: 2},
+	{Name: "monitor", SKU: "DEL-MON-01", Brand: "Dell", Description: "Dell monitor complete with cable.", Stock: 2},
+	{Name: "laptop", SKU: "APL-MBP-13", Brand: "Apple", Description: "Macbook Pro 2017 13-inch.", Stock: 30},
+	{Name: "mouse", SKU: "LOG-M100", Brand: "Logitech", Description: "Logitech M100 black mouse.", Stock: 4},
+	{Name: "mouse pad", SKU: "PAD-001", Description: "Plain black mouse pad.", Stock: 100},
+	{Name: "mug", SKU: "MUG-TKP", Description: "Mug with Tokopedia logo.", Stock: 55},
+	{Name: "notebook", SKU: "NTB-A4", Description: "A4 notebook with strap.", Stock: 6},
+	{Name: "shirt", SKU: "SHT-TKP-BLK", Description: "Black t-shirt with Tokopedia logo.", Stock: 9},
+	{Name: "green chair", SKU: "CHR-GRN-US", Description: "Green chair from the USA.", Stock: 9},
+	{Name: "black chair", SKU: "CHR-BLK-UK", Description: "Black chair from the UK.", Stock: 9},
+}
+
+// seedConcurrency bounds how many seed items are indexed at once.
+const seedConcurrency = 8
+
+// seedIndex indexes the sample inventory in parallel and returns how many
+// items were written. A failed insert doesn't stop the others, the first
+// error is returned once they're all done. Items are written without
+// refreshing, with a single flush at the end.
+func seedIndex(ctx context.Context, store *esStore) (int, error) {
+	var (
+		g       errgroup.Group
+		written int64
+	)
+	g.SetLimit(seedConcurrency)
+	for _, item := range seedItems {
+		item := item
+		g.Go(func() error {
+			if _, err := store.Create(ctx, item, RefreshNone); err != nil {
+				return err
+			}
+			atomic.AddInt64(&written, 1)
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return int(written), err
+	}
+
+	// Flush to make sure the documents got written.
+	if err := store.Flush(ctx); err != nil {
+		return int(written), err
+	}
+	return int(written), nil
+}
+
+// mappingUpdate reports what updateMapping did.
+type mappingUpdate struct {
+	Index string   `json:"index"`
+	Added []string `json:"added"`
+}
+
+// mappingConflictError lists the fields whose mapping in the index can't be
+// changed in place.
+type mappingConflictError struct {
+	Conflicts []string
+}
+
+func (e *mappingConflictError) Error() string {
+	return "mapping conflicts need a reindex: " + strings.Join(e.Conflicts, "; ")
+}
+
+// updateMapping adds the properties of the current mapping that the index
+// doesn't have yet, and the multi-fields missing from those it has, so new
+// optional fields and sub-fields don't need a reindex. Running it again
+// adds nothing. It changes nothing and returns a *mappingConflictError if
+// a field or sub-field already in the index has a different type or
+// analyzer, since those only change by reindexing.
+func updateMapping(ctx context.Context, client *elastic.Client, index string) (mappingUpdate, error) {
+	update := mappingUpdate{Index: index, Added: []string{}}
+	want, err := schema.Properties()
+	if err != nil {
+		return update, err
+	}
+	have, err := indexProperties(ctx, client, index)
+	if err != nil {
+		return update, err
+	}
+
+	added := map[string]interface{}{}
+	var conflicts []string
+	for _, field := range sortedKeys(want) {
+		current, ok := have[field]
+		if !ok {
+			added[field] = want[field]
+			update.Added = append(update.Added, field)
+			continue
+		}
+		conflicts = append(conflicts, settingConflicts(field, want[field], current)...)
+
+		// Multi-fields can be added to an existing field, by putting it
+		// again with just the new ones.
+		wantFields, haveFields := subFields(want[field]), subFields(current)
+		newFields := map[string]interface{}{}
+		for _, sub := range sortedKeys(wantFields) {
+			name := field + "." + sub
+			if currentSub, ok := haveFields[sub]; ok {
+				conflicts = append(conflicts, settingConflicts(name, wantFields[sub], currentSub)...)
+				continue
+			}
+			newFields[sub] = wantFields[sub]
+			update.Added = append(update.Added, name)
+		}
+		if len(newFields) > 0 {
+			property := map[string]interface{}{}
+			for k, v := range want[field] {
+				property[k] = v
+			}
+			property["fields"] = newFields
+			added[field] = property
+		}
+	}
+	if len(conflicts) > 0 {
+		return update, &mappingConflictError{Conflicts: conflicts}
+	}
+	if len(added) == 0 {
+		return update, nil
+	}
+
+	res, err := client.PutMapping().
+		Index(index).
+		Type("item").
+		BodyJson(map[string]interface{}{"properties": added}).
+		Do(ctx)
+	if err != nil {
+		return update, err
+	}
+	if !res.Acknowledged {
+		fmt.Printf("Mapping update of %s not acknowledged\n", index)
+	}
+	return update, nil
+}
+
+// indexProperties returns the item properties currently mapped in index.
+func indexProperties(ctx context.Context, client *elastic.Client, index string) (map[string]map[string]interface{}, error) {
+	res, err := client.GetMapping().Index(index).Type("item").Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// The response is keyed by concrete index name, which differs from
+	// index if it's an alias.
+	raw, err := json.Marshal(res)
+	if err != nil {
+		return nil, err
+	}
+	var indices map[string]struct {
+		Mappings struct {
+			Item struct {
+				Properties map[string]map[string]interface{} `json:"properties"`
+			} `json:"item"`
+		} `json:"mappings"`
+	}
+	if err := json.Unmarshal(raw, &indices); err != nil {
+		return nil, err
+	}
+	for _, mapping := range indices {
+		return mapping.Mappings.Item.Properties, nil
+	}
+	return nil, fmt.Errorf("no mapping found for index %s", index)
+}
+
+// settingConflicts describes how the type and analyzer of field differ
+// between the wanted and the current property mapping.
+func settingConflicts(field string, want, current map[string]interface{}) []string {
+	var conflicts []string
+	for _, setting := range []string{"type", "analyzer"} {
+		if w, h := mappingSetting(want, setting), mappingSetting(current, setting); w != h {
+			conflicts = append(conflicts, fmt.Sprintf("%s has %s %q in the index but %q in the mapping", field, setting, h, w))
+		}
+	}
+	return conflicts
+}
+
+// subFields returns the multi-fields of a property mapping by name.
+func subFields(property map[string]interface{}) map[string]map[string]interface{} {
+	fields := map[string]map[string]interface{}{}
+	raw, _ := property["fields"].(map[string]interface{})
+	for name, sub := range raw {
+		if sub, ok := sub.(map[string]interface{}); ok {
+			fields[name] = sub
+		}
+	}
+	return fields
+}
+
+// mappingSetting returns a setting of a property mapping. Properties
+// without a type are objects, and text without an analyzer uses the
+// standard one.
+func mappingSetting(property map[string]interface{}, setting string) string {
+	if v, ok := property[setting].(string); ok {
+		return v
+	}
+	switch setting {
+	case "type":
+		return "object"
+	case "analyzer":
+		if property["type"] == "text" {
+			return "standard"
+		}
+	}
+	return ""
+}
+
+func sortedKeys(m map[string]map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"invento-search/schema"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// mappingES serves the current mapping as changed by edit as the mapping of
+// index items, and acknowledges mapping updates.
+func mappingES(t *testing.T, edit func(properties map[string]map[string]interface{})) esHandler {
+	t.Helper()
+	properties, err := schema.Properties()
+	if err != nil {
+		t.Fatal(err)
+	}
+	edit(properties)
+	return func(req esRequest) (int, interface{}) {
+		if req.Method == "PUT" {
+			return http.StatusOK, map[string]interface{}{"acknowledged": true}
+		}
+		return http.StatusOK, map[string]interface{}{
+			"items": map[string]interface{}{"mappings": map[string]interface{}{"item": map[string]interface{}{"properties": properties}}},
+		}
+	}
+}
+
+func TestUpdateMappingSubFields(t *testing.T) {
+	client, es := newFakeES(t, mappingES(t, func(properties map[string]map[string]interface{}) {
+		delete(properties["description"]["fields"].(map[string]interface{}), "en")
+	}))
+	update, err := updateMapping(context.Background(), client, "items")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"description.en"}; !reflect.DeepEqual(update.Added, want) {
+		t.Errorf("added %v, want %v", update.Added, want)
+	}
+
+	puts := es.requestsTo("PUT", "/_mapping/item")
+	if len(puts) != 1 {
+		t.Fatalf("put the mapping %d times, want once", len(puts))
+	}
+	var body struct {
+		Properties map[string]struct {
+			Type   string                            `json:"type"`
+			Fields map[string]map[string]interface{} `json:"fields"`
+		} `json:"properties"`
+	}
+	if err := json.Unmarshal([]byte(puts[0].Body), &body); err != nil {
+		t.Fatal(err)
+	}
+	description, ok := body.Properties["description"]
+	if len(body.Properties) != 1 || !ok || description.Type != "text" {
+		t.Fatalf("put %s, want just description as text", puts[0].Body)
+	}
+	if len(description.Fields) != 1 || description.Fields["en"]["analyzer"] != "english" {
+		t.Errorf("put the description sub-fields %v, want just en", description.Fields)
+	}
+}
+
+func TestUpdateMappingUpToDate(t *testing.T) {
+	client, es := newFakeES(t, mappingES(t, func(map[string]map[string]interface{}) {}))
+	update, err := updateMapping(context.Background(), client, "items")
+	if err != nil || len(update.Added) > 0 {
+		t.Errorf("updating a current mapping added %v (%v)", update.Added, err)
+	}
+	if puts := es.requestsTo("PUT", "/_mapping/item"); len(puts) > 0 {
+		t.Errorf("updating a current mapping put %v", puts)
+	}
+}
+
+func TestUpdateMappingSubFieldConflict(t *testing.T) {
+	client, es := newFakeES(t, mappingES(t, func(properties map[string]map[string]interface{}) {
+		fields := properties["description"]["fields"].(map[string]interface{})
+		fields["id"] = map[string]interface{}{"type": "text", "analyzer": "standard"}
+		delete(fields, "en")
+	}))
+	_, err := updateMapping(context.Background(), client, "items")
+	conflict, ok := err.(*mappingConflictError)
+	if !ok || len(conflict.Conflicts) != 1 || !strings.Contains(conflict.Conflicts[0], `description.id has analyzer "standard" in the index but "indonesian" in the mapping`) {
+		t.Errorf("updateMapping = %v, want a conflict on description.id", err)
+	}
+	// Nothing is added when something conflicts.
+	if puts := es.requestsTo("PUT", "/_mapping/item"); len(puts) > 0 {
+		t.Errorf("a conflicting update put %v", puts)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"gopkg.in/olivere/elastic.v6"
+	"time"
+)
+
+// logIndexStats logs how many items index holds and how much disk its
+// primary shards take, as a cheap record of its growth.
+func logIndexStats(ctx context.Context, client *elastic.Client, index string) {
+	count, err := client.Count(index).Do(ctx)
+	if err != nil {
+		fmt.Printf("Counting the items in %s: %v\n", index, err)
+		return
+	}
+	size := "unknown size"
+	stats, err := client.IndexStats(index).Do(ctx)
+	if err != nil {
+		fmt.Printf("Getting the stats of %s: %v\n", index, err)
+	} else if all := stats.All; all != nil && all.Primaries != nil && all.Primaries.Store != nil {
+		size = formatBytes(all.Primaries.Store.SizeInBytes)
+	}
+	fmt.Printf("Index %s holds %d items, %s\n", index, count, size)
+}
+
+// watchIndexStats logs the index stats every interval until ctx is done.
+func watchIndexStats(ctx context.Context, client *elastic.Client, index string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			logIndexStats(ctx, client, index)
+		}
+	}
+}
+
+// formatBytes formats n as a binary multiple such as 1.5 MiB.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
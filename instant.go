@@ -0,0 +1,77 @@
+package main
+
+import (
+	"gopkg.in/olivere/elastic.v6"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Instant search asks for few results per keystroke.
+const (
+	defaultInstantSize = 10
+	maxInstantSize     = 50
+)
+
+// instantHit is an item as the instant search box lists it.
+type instantHit struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	SKU  string `json:"sku,omitempty"`
+}
+
+// instantResult is the /api/instant response body.
+type instantResult struct {
+	Items []instantHit `json:"items"`
+}
+
+// instantHandler matches the text typed so far against item names, for a
+// search box that updates on every keystroke. Every word must be the start
+// of a word in the name, so the last, half-typed word matches too, and
+// names with the words next to each other in the typed order rank higher.
+//
+// Elasticsearch 6 has no search_as_you_type field, so it's put together
+// from the name.prefix, name.2gram and name.3gram sub-fields instead.
+func instantHandler(cfg Config, client *elastic.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		result := instantResult{Items: []instantHit{}}
+		text := strings.TrimSpace(r.FormValue("q"))
+		if text == "" {
+			writeJSON(w, r, http.StatusOK, result)
+			return
+		}
+		size := defaultInstantSize
+		if v := r.FormValue("size"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > maxInstantSize {
+				http.Error(w, "size must be a number from 1 to "+strconv.Itoa(maxInstantSize), http.StatusBadRequest)
+				return
+			}
+			size = n
+		}
+
+		query := elastic.NewBoolQuery().
+			Must(elastic.NewMatchQuery("name.prefix", text).Operator("and")).
+			Should(elastic.NewMultiMatchQuery(text, "name", "name.2gram", "name.3gram").Type("most_fields"))
+		res, err := client.Search().
+			Index(cfg.IndexName).
+			Timeout(esDuration(cfg.SearchTimeout)).
+			Query(query).
+			FetchSourceContext(elastic.NewFetchSourceContext(true).Include("name", "sku")).
+			Size(size).
+			Do(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for _, hit := range res.Hits.Hits {
+			item, err := decodeItemSource(hit.Source, hit.Id)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			result.Items = append(result.Items, instantHit{ID: item.ID, Name: item.Name, SKU: item.SKU})
+		}
+		writeJSON(w, r, http.StatusOK, result)
+	}
+}
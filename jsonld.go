@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"invento-search/schema"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// jsonLDProduct is a schema.org Product, for search engines.
+type jsonLDProduct struct {
+	Context     string       `json:"@context"`
+	Type        string       `json:"@type"`
+	Name        string       `json:"name"`
+	Description string       `json:"description,omitempty"`
+	SKU         string       `json:"sku,omitempty"`
+	Brand       *jsonLDBrand `json:"brand,omitempty"`
+	Image       string       `json:"image,omitempty"`
+	Offers      *jsonLDOffer `json:"offers,omitempty"`
+}
+
+type jsonLDBrand struct {
+	Type string `json:"@type"`
+	Name string `json:"name"`
+}
+
+type jsonLDOffer struct {
+	Type          string `json:"@type"`
+	Price         string `json:"price"`
+	PriceCurrency string `json:"priceCurrency"`
+	Availability  string `json:"availability"`
+}
+
+// productJSONLD describes item as schema.org Product JSON-LD, for the
+// item page's head. Relative image paths are made absolute against the
+// request's host, and only priced items get an offer, with their
+// availability following the stock.
+//
+// encoding/json escapes <, > and &, so the result can't close the script
+// element it's placed in.
+func productJSONLD(r *http.Request, currency string, item schema.Item) (template.JS, error) {
+	product := jsonLDProduct{
+		Context:     "https://schema.org",
+		Type:        "Product",
+		Name:        item.Name,
+		Description: item.Description,
+		SKU:         item.SKU,
+		Image:       absoluteURL(r, item.Image),
+	}
+	if item.Brand != "" {
+		product.Brand = &jsonLDBrand{Type: "Brand", Name: item.Brand}
+	}
+	if item.Price > 0 {
+		product.Offers = &jsonLDOffer{
+			Type:          "Offer",
+			Price:         strconv.FormatFloat(item.Price, 'f', 2, 64),
+			PriceCurrency: currency,
+			Availability:  "https://schema.org/OutOfStock",
+		}
+		if item.Stock > 0 {
+			product.Offers.Availability = "https://schema.org/InStock"
+		}
+	}
+	b, err := json.Marshal(product)
+	if err != nil {
+		return "", err
+	}
+	return template.JS(b), nil
+}
+
+// absoluteURL resolves ref against the URL the request was made to.
+func absoluteURL(r *http.Request, ref string) string {
+	if ref == "" {
+		return ""
+	}
+	u, err := url.Parse(ref)
+	if err != nil {
+		return ""
+	}
+	base := &url.URL{Scheme: "http", Host: r.Host, Path: r.URL.Path}
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		base.Scheme = "https"
+	}
+	return base.ResolveReference(u).String()
+}
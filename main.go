@@ -2,317 +2,232 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
-	"gopkg.in/olivere/elastic.v6"
-	"html/template"
+	"invento-search/bootstrap"
 	"invento-search/schema"
 	"net/http"
-	"reflect"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
-const indexName = "items"
-
-const mapping = `
-{
-	"settings":{
-		"number_of_shards": 1,
-		"number_of_replicas": 0
-	},
-	"mappings":{
-		"item":{
-			"properties":{
-				"id": {
-					"type":"text"
-				},
-				"name":{
-					"type":"keyword"
-				},
-				"description":{
-					"type":"text",
-					"store": true,
-					"fielddata": true
-				},
-				"image":{
-					"type":"keyword"
-				},
-				"created":{
-					"type":"date"
-				},
-				"tags":{
-					"type":"keyword"
-				},
-				"location":{
-					"type":"geo_point"
-				},
-				"suggest_field":{
-					"type":"completion"
-				}
-			}
-		}
-	}
-}`
+// shutdownTimeout is how long in-flight requests get to finish on shutdown.
+const shutdownTimeout = 30 * time.Second
 
 func main() {
 	// Create context.
 	ctx := context.Background()
 
-	// Create new client.
-	client, err := elastic.NewClient()
+	// Load configuration.
+	cfg, err := LoadConfig()
 	if err != nil {
-		panic(err)
+		fmt.Println(err)
+		os.Exit(1)
 	}
 
-	// Delete an index.
-	deleteIndex, err := client.DeleteIndex(indexName).Do(ctx)
+	// Create new client.
+	esBreaker := newBreaker(cfg.BreakerThreshold)
+	client, err := newElasticClient(cfg, esBreaker)
 	if err != nil {
 		panic(err)
 	}
-	if !deleteIndex.Acknowledged {
-		fmt.Printf("Index not acknowledged")
-	}
-
-	// Check if index already exists.
-	exists, err := client.IndexExists(indexName).Do(ctx)
+	readyClient, err := newReadyClient(cfg, esBreaker)
 	if err != nil {
 		panic(err)
 	}
-	if !exists {
-		// Create a new index.
-		createIndex, err := client.CreateIndex(indexName).BodyString(mapping).Do(ctx)
-		if err != nil {
-			panic(err)
-		}
-		if !createIndex.Acknowledged {
-			fmt.Printf("Index not acknowledged")
-		}
-	}
 
-	// Populate some items.
-	items := []schema.Item{
-		{Name: "pedestal", Description: "3-tier white-colored pedestal.", Stock: 1},
-		{Name: "desk", Description: "Black wooden desk.", Stock: 15},
-		{Name: "monitor", Description: "LG monitor complete with cable.", Stock: 2},
-		{Name: "monitor", Description: "Samsung monitor complete with cable.", Stock: 2},
-		{Name: "monitor", Description: "Apple monitor complete with cable.", Stock: 2},
-		{Name: "monitor", Description: "Dell monitor complete with cable.", Stock: 2},
-		{Name: "laptop", Description: "Macbook Pro 2017 13-inch.", Stock: 30},
-		{Name: "mouse", Description: "Logitech M100 black mouse.", Stock: 4},
-		{Name: "mouse pad", Description: "Plain black mouse pad.", Stock: 100},
-		{Name: "mug", Description: "Mug with Tokopedia logo.", Stock: 55},
-		{Name: "notebook", Description: "A4 notebook with strap.", Stock: 6},
-		{Name: "shirt", Description: "Black t-shirt with Tokopedia logo.", Stock: 9},
-		{Name: "green chair", Description: "Green chair from the USA.", Stock: 9},
-		{Name: "black chair", Description: "Black chair from the UK.", Stock: 9},
-	}
-	for _, item := range items {
-		_, err = client.Index().
-			Index(indexName).
-			Type("item").
-			BodyJson(item).
-			Do(ctx)
-	}
-	if err != nil {
+	events := newEventBus()
+	events.subscribe("log", 256, func(e itemEvent) {
+		if e.ItemID == "" {
+			logf(contextWithRequestID(ctx, e.RequestID), "Items %s\n", e.Type)
+			return
+		}
+		logf(contextWithRequestID(ctx, e.RequestID), "Item %s %s\n", e.ItemID, e.Type)
+	})
+	store := newESStore(cfg, client, events)
+	if err := store.StartBulk(ctx, cfg.BulkBatchSize, cfg.BulkWorkers, cfg.BulkFlushInterval); err != nil {
 		panic(err)
 	}
+	// The pages read items through a cache, kept current by the events.
+	cache := newItemCache(cfg.ItemCacheSize, cfg.ItemCacheTTL)
+	cache.watch(events)
+	items := &cachedStore{ItemStore: store, cache: cache}
+	health := &readiness{}
 
-	// Flush to make sure the documents got written.
-	_, err = client.Flush().Index(indexName).Do(ctx)
+	// Page
+	templates, err := loadTemplates(cfg.TemplateDir, templateFuncs(cfg))
 	if err != nil {
 		panic(err)
 	}
-
-	// Page
-	welcome := schema.Welcome{"Nakama"}
-	templates := template.Must(template.ParseFiles(
-		"templates/landing-page.html",
-		"templates/item.html",
-		"templates/create.html",
-		"templates/list.html",
-		"templates/edit.html"))
-	http.Handle("/static/", //final url can be anything
+	routes := newRouteTable(cfg.AdminToken, esBreaker, templates)
+	routes.handle(route{Path: "/static/", Methods: getOnly, Description: "Static assets.", Offline: true}, //final url can be anything
 		http.StripPrefix("/static/",
 			http.FileServer(http.Dir("static"))))
 
-	// Landing page
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		// Set welcome message name according to URL param
-		if username := r.FormValue("username"); username != "" {
-			welcome.Username = username
-		}
-		if r.Method == "POST" {
-			if name := r.FormValue("name"); name != "" {
-				http.Redirect(w, r, "/search?name="+name, http.StatusSeeOther)
-			}
-		}
+	// Health
+	routes.handle(route{Path: "/healthz", Methods: getOnly, Description: "Reports whether the index is ready.", Offline: true},
+		healthzHandler(health, esBreaker))
+	routes.handle(route{Path: "/version", Methods: getOnly, Params: []string{"pretty"}, Offline: true,
+		Description: "Reports the build version, commit and uptime."},
+		versionHandler())
+
+	// Admin
+	routes.handle(route{Path: "/admin/reset", Methods: postOnly, Params: []string{"seed", "confirm"}, Admin: true,
+		Description: "Deletes and recreates the index, needs ALLOW_RESET=true."},
+		resetHandler(cfg, client, readyClient, store))
+	routes.handle(route{Path: "/admin/analyze", Methods: getOnly, Params: []string{"text", "analyzer", "field", "pretty"}, Admin: true,
+		Description: "Shows how text is tokenized by an analyzer or a field's analyzer."},
+		analyzeHandler(cfg, client))
+
+	routes.handle(route{Path: "/admin/mapping", Methods: putOnly, Params: []string{"pretty"}, Admin: true,
+		Description: "Adds new mapping fields to the index in place."},
+		mappingHandler(cfg, client))
+	routes.handle(route{Path: "/admin/forcemerge", Methods: postOnly, Params: []string{"segments", "pretty"}, Admin: true,
+		Description: "Merges the index segments, after big imports."},
+		forcemergeHandler(cfg, client))
+	routes.handle(route{Path: "/admin/items/", Methods: getOnly, Params: []string{"pretty"}, Admin: true,
+		Description: "/admin/items/{id}/raw returns the stored document with its metadata."},
+		rawItemHandler(store))
+
+	// Pages
+	popular := newSearchStats(1024, cfg.PopularSearchTerms)
+	site := &pages{
+		cfg:       cfg,
+		store:     items,
+		templates: templates,
+		breaker:   esBreaker,
+		recent:    newRecentItems(cfg.CookieSecret),
+		popular:   popular,
+		welcome:   schema.Welcome{Username: "Nakama"},
+	}
 
-		if err := templates.ExecuteTemplate(w, "landing-page.html", welcome); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-		}
-	})
+	// Landing page
+	routes.handleFunc(route{Path: "/", Methods: getAndPost, Params: []string{"username", "name"}, Offline: true,
+		Description: "Landing page with the search box."}, site.landing)
 
 	// Item page
-	http.HandleFunc("/items/", func(w http.ResponseWriter, r *http.Request) {
-		// Set welcome message name according to URL param
-		var item schema.Item
-
-		if id := r.FormValue("id"); id != "" {
-			// Get item with specified ID
-			itemResult, err := client.Get().
-				Index(indexName).
-				Type("item").
-				Id(id).
-				Do(ctx)
-			if err != nil {
-				// Handle error
-				panic(err)
-			}
-			if itemResult.Found {
-				fmt.Printf("Got document %s in version %d from index %s, type %s\n", itemResult.Id, itemResult.Version, itemResult.Index, itemResult.Type)
-				err := json.Unmarshal(*itemResult.Source, &item)
-				if err != nil {
-					panic(err)
-				}
-			} else {
-				fmt.Printf("Document %s not found", id)
-			}
-		}
-
-		if err := templates.ExecuteTemplate(w, "item.html", item); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-		}
-	})
+	routes.handleFunc(route{Path: "/items/", Methods: getOnly, Params: []string{"id"},
+		Description: "Shows an item."}, site.item)
 
 	// Create item page
-	http.HandleFunc("/create/", func(w http.ResponseWriter, r *http.Request) {
-		item := schema.Item{
-			Name:        r.FormValue("name"),
-			Description: r.FormValue("description"),
-		}
-
-		// Index a item (using JSON serialization)
-		newItem := schema.Item{Name: item.Name, Description: item.Description, Stock: 1}
-		putItem, err := client.Index().
-			Index(indexName).
-			Type("item").
-			BodyJson(newItem).
-			Do(ctx)
-		if err != nil {
-			panic(err)
-		}
-
-		// Flush to make sure the documents got written.
-		_, err = client.Flush().Index(indexName).Do(ctx)
-		if err != nil {
-			panic(err)
-		}
-
-		fmt.Printf("Indexed item %s to index %s, type %s\n", putItem.Id, putItem.Index, putItem.Type)
-
-		if err := templates.ExecuteTemplate(w, "create.html", item); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-		}
-	})
+	routes.handleFunc(route{Path: "/create/", Methods: getAndPost,
+		Params:      []string{"name", "sku", "brand", "category", "description", "notes", "stock", "price", "tags", "checkDuplicate"},
+		Description: "Creates an item."}, site.create)
 
 	// Edit item page
-	http.HandleFunc("/edit/", func(w http.ResponseWriter, r *http.Request) {
-		// Get item
-		var item schema.Item
-		if id := r.FormValue("id"); id != "" {
-			// Get item with specified ID
-			itemResult, err := client.Get().
-				Index(indexName).
-				Type("item").
-				Id(id).
-				Do(ctx)
-			if err != nil {
-				panic(err)
-			}
-			if itemResult.Found {
-				fmt.Printf("Got document %s in version %d from index %s, type %s\n", itemResult.Id, itemResult.Version, itemResult.Index, itemResult.Type)
-				err := json.Unmarshal(*itemResult.Source, &item)
-				if err != nil {
-					panic(err)
-				}
-			} else {
-				fmt.Printf("Document %s not found", id)
-			}
-		}
-		if r.Method == "POST" {
-			if id := r.FormValue("id"); id != "" {
-				update, err := client.Update().Index(indexName).Type("item").Id(id).
-					Script(elastic.NewScriptInline("ctx._source.name = params.name").Lang("painless").Param("name", item.Name)).
-					Upsert(map[string]interface{}{"name": ""}).
-					Do(ctx)
-				if err != nil {
-					panic(err)
-				}
-				fmt.Printf("New version of item %q is now %d\n", update.Id, update.Version)
-				// Flush to make sure the documents got written.
-				_, err = client.Flush().Index(indexName).Do(ctx)
-				if err != nil {
-					panic(err)
-				}
-				// Flush to make sure the documents got written.
-				_, err = client.Flush().Index(indexName).Do(ctx)
-				if err != nil {
-					panic(err)
-				}
-
-				http.Redirect(w, r, "/items?id="+id, http.StatusSeeOther)
-			}
-		}
+	routes.handleFunc(route{Path: "/edit/", Methods: getAndPost,
+		Params:      []string{"id", "name", "description", "notes", "stock", "tags", "brand", "category", "price"},
+		Description: "Edits an item."}, site.edit)
 
-		if err := templates.ExecuteTemplate(w, "edit.html", item); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-		}
-	})
+	// Delete item
+	routes.handleFunc(route{Path: "/delete/", Methods: postOnly, Params: []string{"id"},
+		Description: "Deletes an item."}, site.delete)
 
 	// Search item.
-	http.HandleFunc("/search/", func(w http.ResponseWriter, r *http.Request) {
-		var items []schema.Item
-		if name := r.FormValue("name"); name != "" {
-			termQuery := elastic.NewTermQuery("name", name)
-			searchResult, err := client.Search().
-				Index(indexName).
-				Query(termQuery).
-				Sort("name", true).
-				From(0).Size(100).
-				Pretty(true).
-				Do(ctx)
-			if err != nil {
-				panic(err)
-			}
-
-			var ttyp schema.Item
-			for _, item := range searchResult.Each(reflect.TypeOf(ttyp)) {
-				if t, ok := item.(schema.Item); ok {
-					fmt.Printf("Item named %s: %s\n", t.Name, t.Description)
-				}
-			}
-
-			if searchResult.Hits.TotalHits > 0 {
-				for _, hit := range searchResult.Hits.Hits {
-					var t schema.Item
-					err := json.Unmarshal(*hit.Source, &t)
-					if err != nil {
-						// Deserialization failed
-					}
-
-					// Work with item
-					fmt.Printf("Item named %s: %s\n", t.Name, t.Description)
-					items = append(items, t)
-				}
-			} else {
-				fmt.Print("Found no items\n")
-			}
-		}
-
-		if err := templates.ExecuteTemplate(w, "list.html", items); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-		}
+	routes.handleFunc(route{Path: "/search/", Methods: getAndPost, Params: searchParams,
+		Description: "Search results page."}, site.search)
+
+	// Search API
+	routes.handle(route{Path: "/api/search", Methods: getOnly, Params: withParams(searchParams, "debug", "pretty"),
+		Description: "Search results as JSON."},
+		apiSearchHandler(cfg, items, popular))
+	routes.handle(route{Path: "/api/search/counts", Methods: getOnly, Params: withParams(searchParams, "pretty"),
+		Description: "Counts matching and in-stock items without fetching them."},
+		stockCountsHandler(cfg, client))
+	routes.handle(route{Path: "/api/search/explain", Methods: getOnly, Params: withParams(searchParams, "id", "pretty"),
+		Description: "Explains how an item scores against a search, needs ALLOW_EXPLAIN=true."},
+		explainHandler(cfg, client, store))
+	routes.handle(route{Path: "/api/instant", Methods: getOnly, Params: []string{"q", "size", "pretty"},
+		Description: "Matches item names as they're typed, for instant search."},
+		instantHandler(cfg, client))
+	routes.handle(route{Path: "/api/popular-searches", Methods: getOnly, Params: []string{"n", "pretty"},
+		Description: "Most searched terms."},
+		popularSearchesHandler(popular))
+
+	routes.handle(route{Path: "/api/facets", Methods: getOnly, Params: []string{"field", "size", "after", "pretty"},
+		Description: "Lists the distinct values of brand, category or tags, for filters."},
+		facetsHandler(cfg, client))
+	routes.handle(route{Path: "/api/low-stock", Methods: getOnly, Params: []string{"threshold", "from", "size", "pretty"},
+		Description: "Items with stock below the threshold, lowest first."},
+		lowStockHandler(cfg, client))
+
+	routes.handle(route{Path: "/api/map", Methods: getOnly,
+		Params:      withParams(searchParams, "precision", "top", "left", "bottom", "right", "pretty"),
+		Description: "Clusters matching items by location for a map."},
+		mapHandler(cfg, client))
+
+	routes.handle(route{Path: "/api/export", Methods: getOnly, Params: withParams(searchParams, "confirm"), Admin: true,
+		Description: "Streams the matching items as newline-delimited JSON."},
+		exportHandler(cfg, items))
+
+	routes.handle(route{Path: "/api/stock/bulk", Methods: postOnly,
+		Description: "Sets stock levels from a sku,stock CSV body."},
+		bulkStockHandler(items))
+
+	routes.handle(route{Path: "/api/bulk-tag", Methods: postOnly, Params: []string{"tag", "name", "category", "confirm", "pretty"}, Admin: true,
+		Description: "Adds a tag to every item matching name and category."},
+		bulkTagHandler(cfg, client, events))
+
+	routes.handle(route{Path: "/api/items/", Methods: []string{"PATCH"}, Params: []string{"pretty"},
+		Description: "/api/items/{id}/{field} sets one field of an item to the JSON body."},
+		itemFieldHandler(items))
+
+	routes.handle(route{Path: "/api/import", Methods: postOnly, Params: []string{"onConflict"}, Admin: true,
+		Description: "Stores the items in a newline-delimited JSON body, as exported."},
+		importHandler(items))
+
+	// API index, registered last so it lists itself too.
+	routes.handle(route{Path: "/api", Methods: getOnly, Params: []string{"pretty"}, Offline: true,
+		Description: "Lists the available endpoints."},
+		routes.indexHandler())
+
+	// Start listening straight away so /healthz can report that the index
+	// isn't ready yet.
+	server := &http.Server{Addr: ":" + cfg.Port, Handler: withRequestID(http.DefaultServeMux)}
+	serveErr := make(chan error, 1)
+	go func() {
+		fmt.Printf("Listening on port :%s\n", cfg.Port)
+		serveErr <- server.ListenAndServe()
+	}()
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+
+	// Create the index and seed it the first time round.
+	err = bootstrap.Bootstrap(ctx, client, bootstrap.Config{
+		Index:        cfg.IndexName,
+		ReadyTimeout: cfg.IndexReadyTimeout,
+		ReadyClient:  readyClient,
+		Seed:         func(ctx context.Context) (int, error) { return seedIndex(ctx, store) },
 	})
-
-	fmt.Println("Listening on port :8080")
-	fmt.Println(http.ListenAndServe(":8080", nil))
+	if err != nil {
+		fmt.Println(err)
+		server.Close()
+		os.Exit(1)
+	}
+	health.setReady()
+	logIndexStats(ctx, client, cfg.IndexName)
+
+	// Background work, stopped on shutdown.
+	background, stopBackground := context.WithCancel(ctx)
+	go esBreaker.watch(background, client, cfg.ElasticsearchURL, cfg.HealthCheckInterval)
+	go watchIndexStats(background, client, cfg.IndexName, cfg.IndexStatsInterval)
+
+	select {
+	case err := <-serveErr:
+		fmt.Println(err)
+	case sig := <-stop:
+		// Let requests finish feeding the bulk processor before it's
+		// closed.
+		fmt.Printf("Got %s, shutting down\n", sig)
+		shutdownCtx, cancel := context.WithTimeout(ctx, shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			fmt.Println(err)
+		}
+	}
+	stopBackground()
+	if err := store.Close(); err != nil {
+		fmt.Printf("Closing the bulk processor: %v\n", err)
+	}
 }
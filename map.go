@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"gopkg.in/olivere/elastic.v6"
+	"invento-search/search"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// maxMapBuckets caps how many geohash cells /api/map returns.
+const maxMapBuckets = 10000
+
+// errInvalidViewport is returned for incomplete or malformed viewports.
+var errInvalidViewport = errors.New("viewport needs top, left, bottom and right, all as numbers")
+
+// mapCluster is a geohash cell with the items located in it.
+type mapCluster struct {
+	Geohash string  `json:"geohash"`
+	Count   int64   `json:"count"`
+	Lat     float64 `json:"lat"`
+	Lon     float64 `json:"lon"`
+}
+
+// mapResult is the /api/map response body.
+type mapResult struct {
+	Precision int          `json:"precision"`
+	Clusters  []mapCluster `json:"clusters"`
+}
+
+// viewport is the map area a client is showing.
+type viewport struct {
+	top, left, bottom, right float64
+}
+
+// mapHandler clusters the items matching a search by location, for the
+// warehouse map. Each cluster is a geohash cell placed at the centroid of
+// its items. The precision defaults to MAP_PRECISION, and top, left,
+// bottom and right limit the clusters to the viewport.
+func mapHandler(cfg Config, client *elastic.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		params, err := parseSearchParams(cfg, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		result := mapResult{Precision: cfg.MapPrecision, Clusters: []mapCluster{}}
+		if v := r.FormValue("precision"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > 12 {
+				http.Error(w, "precision must be a number from 1 to 12", http.StatusBadRequest)
+				return
+			}
+			result.Precision = n
+		}
+		view, ok, err := parseViewport(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if ok && view.top <= view.bottom {
+			// Nothing fits in a viewport with no height.
+			writeJSON(w, r, http.StatusOK, result)
+			return
+		}
+
+		// Items without a location fall in no cell.
+		query := elastic.NewBoolQuery().Must(search.BuildQuery(params))
+		if ok {
+			query = query.Filter(elastic.NewGeoBoundingBoxQuery("location").
+				TopLeft(view.top, view.left).
+				BottomRight(view.bottom, view.right))
+		}
+		grid := elastic.NewGeoHashGridAggregation().
+			Field("location").
+			Precision(result.Precision).
+			Size(maxMapBuckets).
+			SubAggregation("centroid", elastic.NewGeoCentroidAggregation().Field("location"))
+		start := time.Now()
+		searchResult, err := client.Search().
+			Index(searchIndices(cfg, params)...).
+			IgnoreUnavailable(true).
+			Query(query).
+			Aggregation("grid", grid).
+			Size(0).
+			Do(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		logSlowSearch(r.Context(), cfg, params, query, time.Since(start), searchResult.TookInMillis)
+
+		if agg, found := searchResult.Aggregations.GeoHash("grid"); found {
+			for _, bucket := range agg.Buckets {
+				cluster := mapCluster{Count: bucket.DocCount}
+				cluster.Geohash, _ = bucket.Key.(string)
+				if centroid, found := bucket.GeoCentroid("centroid"); found {
+					cluster.Lat, cluster.Lon = centroid.Location.Latitude, centroid.Location.Longitude
+				}
+				result.Clusters = append(result.Clusters, cluster)
+			}
+		}
+		writeJSON(w, r, http.StatusOK, result)
+	}
+}
+
+// parseViewport reads the top, left, bottom and right params. It reports
+// false if none are given, and an error if only some are.
+func parseViewport(r *http.Request) (viewport, bool, error) {
+	names := []string{"top", "left", "bottom", "right"}
+	var values [4]float64
+	given := 0
+	for i, name := range names {
+		v := r.FormValue(name)
+		if v == "" {
+			continue
+		}
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return viewport{}, false, errInvalidViewport
+		}
+		values[i] = f
+		given++
+	}
+	switch given {
+	case 0:
+		return viewport{}, false, nil
+	case len(names):
+		return viewport{top: values[0], left: values[1], bottom: values[2], right: values[3]}, true, nil
+	}
+	return viewport{}, false, errInvalidViewport
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"gopkg.in/olivere/elastic.v6"
+	"invento-search/schema"
+	"invento-search/search"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// memoryStore keeps items in memory, for handler tests that shouldn't need
+// an Elasticsearch cluster. Writes are visible straight away, whatever the
+// refresh policy.
+//
+// Its search is only a rough stand-in for the real one, see Search.
+type memoryStore struct {
+	events *eventBus
+
+	mu     sync.RWMutex
+	items  map[string]schema.Item
+	nextID int
+}
+
+var _ ItemStore = (*memoryStore)(nil)
+
+// newMemoryStore returns an empty store, publishing an event on events
+// after every successful write like esStore does. events may be nil.
+func newMemoryStore(events *eventBus) *memoryStore {
+	return &memoryStore{events: events, items: map[string]schema.Item{}}
+}
+
+// Get returns the item with the given id.
+func (s *memoryStore) Get(ctx context.Context, id string) (schema.Item, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	item, found := s.items[id]
+	if !found {
+		return schema.Item{}, errMemoryNotFound(id)
+	}
+	return copyItem(item), nil
+}
+
+// GetMany returns the items with the given ids in the order given,
+// skipping unknown ids.
+func (s *memoryStore) GetMany(ctx context.Context, ids []string) ([]schema.Item, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var items []schema.Item
+	for _, id := range ids {
+		if item, found := s.items[id]; found {
+			items = append(items, copyItem(item))
+		}
+	}
+	return items, nil
+}
+
+// Search returns a page of the items matching params, sorted by name and
+// then id. Name and ExcludeName compare names exactly. Query and each
+// refinement match items with any of their words in the name, ignoring
+// case. Wildcard patterns are matched against the name and SKU, and the
+// brand, tag and stock filters apply as usual. Require and Prefer clauses,
+// field boosts, languages, recency, collapsing and the archive are
+// ignored, and there's no scoring.
+func (s *memoryStore) Search(ctx context.Context, params search.Params) (schema.SearchResponse, error) {
+	if err := params.Validate(); err != nil {
+		return schema.SearchResponse{}, err
+	}
+	s.mu.RLock()
+	var matches []schema.Item
+	for _, item := range s.items {
+		if memoryMatch(params, item) {
+			matches = append(matches, copyItem(item))
+		}
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].Name != matches[j].Name {
+			return matches[i].Name < matches[j].Name
+		}
+		return matches[i].ID < matches[j].ID
+	})
+	response := schema.SearchResponse{Total: int64(len(matches))}
+	brands := map[string]int64{}
+	for _, item := range matches {
+		if item.Brand != "" {
+			brands[item.Brand]++
+		}
+	}
+	for brand, count := range brands {
+		response.Brands = append(response.Brands, schema.BrandCount{Brand: brand, Count: count})
+	}
+	sort.Slice(response.Brands, func(i, j int) bool {
+		if response.Brands[i].Count != response.Brands[j].Count {
+			return response.Brands[i].Count > response.Brands[j].Count
+		}
+		return response.Brands[i].Brand < response.Brands[j].Brand
+	})
+
+	from, to := params.From, params.From+params.Size
+	if from > len(matches) {
+		from = len(matches)
+	}
+	if to > len(matches) || params.Size <= 0 {
+		to = len(matches)
+	}
+	response.Item = matches[from:to]
+	return response, nil
+}
+
+// memoryMatch reports whether item matches the params memoryStore.Search
+// understands.
+func memoryMatch(p search.Params, item schema.Item) bool {
+	if p.Name != "" && item.Name != p.Name {
+		return false
+	}
+	if p.ExcludeName != "" && item.Name == p.ExcludeName {
+		return false
+	}
+	for _, text := range append([]string{p.Query}, p.Refine...) {
+		if text != "" && !sharesWord(text, item.Name) {
+			return false
+		}
+	}
+	if p.Wildcard != "" {
+		nameMatch, _ := path.Match(p.Wildcard, item.Name)
+		skuMatch, _ := path.Match(p.Wildcard, item.SKU)
+		if !nameMatch && !skuMatch {
+			return false
+		}
+	}
+	if len(p.Brands) > 0 && !containsString(p.Brands, item.Brand) {
+		return false
+	}
+	for _, tag := range p.Tags {
+		if !containsString(item.Tags, tag) {
+			return false
+		}
+	}
+	for _, tag := range p.ExcludeTags {
+		if containsString(item.Tags, tag) {
+			return false
+		}
+	}
+	if p.InStock && item.Stock <= 0 {
+		return false
+	}
+	return true
+}
+
+// FindDuplicate looks for an item with exactly the same name and
+// description as item.
+func (s *memoryStore) FindDuplicate(ctx context.Context, item schema.Item) (schema.Item, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, existing := range s.items {
+		if existing.Name == item.Name && existing.Description == item.Description {
+			return copyItem(existing), true, nil
+		}
+	}
+	return schema.Item{}, false, nil
+}
+
+// Create stores a new item under its id or SKU, or a generated id, failing
+// with a conflict if the id is taken.
+func (s *memoryStore) Create(ctx context.Context, item schema.Item, refresh RefreshPolicy) (string, error) {
+	id, _, err := s.put(ctx, item, true)
+	return id, err
+}
+
+// put stores item under its id or SKU, or a generated id, replacing what
+// was stored there unless createOnly is set. It reports whether the item is
+// new.
+func (s *memoryStore) put(ctx context.Context, item schema.Item, createOnly bool) (string, bool, error) {
+	item, id := prepareItem(item)
+	// Suggestions only matter to Elasticsearch.
+	item.Suggest = nil
+	s.mu.Lock()
+	if id == "" {
+		s.nextID++
+		id = fmt.Sprintf("item-%d", s.nextID)
+	}
+	_, taken := s.items[id]
+	if taken && createOnly {
+		s.mu.Unlock()
+		return id, false, &elastic.Error{Status: http.StatusConflict, Details: &elastic.ErrorDetails{
+			Type:   "version_conflict_engine_exception",
+			Reason: fmt.Sprintf("[item][%s]: version conflict, document already exists", id),
+		}}
+	}
+	item.ID = id
+	s.items[id] = copyItem(item)
+	s.mu.Unlock()
+	eventType := itemCreated
+	if taken {
+		eventType = itemUpdated
+	}
+	s.events.publish(itemEvent{Type: eventType, ItemID: id, RequestID: requestID(ctx)})
+	return id, !taken, nil
+}
+
+// Update applies a partial update document to the item with the given id,
+// by its JSON field names, like an Elasticsearch partial update.
+func (s *memoryStore) Update(ctx context.Context, id string, doc map[string]interface{}, refresh RefreshPolicy) error {
+	s.mu.Lock()
+	item, found := s.items[id]
+	if !found {
+		s.mu.Unlock()
+		return errMemoryNotFound(id)
+	}
+	updated, err := mergeItem(item, doc)
+	if err != nil {
+		s.mu.Unlock()
+		return &elastic.Error{Status: http.StatusBadRequest, Details: &elastic.ErrorDetails{
+			Type:   "mapper_parsing_exception",
+			Reason: err.Error(),
+		}}
+	}
+	s.items[id] = updated
+	s.mu.Unlock()
+	s.events.publish(itemEvent{Type: itemUpdated, ItemID: id, RequestID: requestID(ctx)})
+	return nil
+}
+
+// Delete removes the item with the given id. It reports false if there was
+// no such item.
+func (s *memoryStore) Delete(ctx context.Context, id string, refresh RefreshPolicy) (bool, error) {
+	s.mu.Lock()
+	_, found := s.items[id]
+	delete(s.items, id)
+	s.mu.Unlock()
+	if !found {
+		return false, nil
+	}
+	s.events.publish(itemEvent{Type: itemDeleted, ItemID: id, RequestID: requestID(ctx)})
+	return true, nil
+}
+
+// Export calls each with the items matching params in Search's order,
+// ignoring paging.
+func (s *memoryStore) Export(ctx context.Context, params search.Params, each func(schema.Item) error) error {
+	params.From, params.Size = 0, 0
+	res, err := s.Search(ctx, params)
+	if err != nil {
+		return err
+	}
+	for _, item := range res.Item {
+		if err := each(item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Bulk starts a batch of writes, which memoryStore applies as they're
+// queued.
+func (s *memoryStore) Bulk() bulkWriter {
+	return &memoryBulkWriter{store: s, outcomes: map[int]writeOutcome{}}
+}
+
+// Refresh does nothing, writes are visible straight away.
+func (s *memoryStore) Refresh(ctx context.Context) error {
+	return nil
+}
+
+// memoryBulkWriter is the bulkWriter of a memoryStore.
+type memoryBulkWriter struct {
+	store    *memoryStore
+	outcomes map[int]writeOutcome
+}
+
+func (b *memoryBulkWriter) Put(ctx context.Context, key int, item schema.Item, createOnly bool) {
+	id, created, err := b.store.put(ctx, item, createOnly)
+	b.outcomes[key] = writeOutcome{ID: id, Created: created, Err: err}
+}
+
+func (b *memoryBulkWriter) SetStock(ctx context.Context, key int, sku string, stock int) {
+	b.store.mu.RLock()
+	var id string
+	for _, item := range b.store.items {
+		if item.SKU == sku {
+			id = item.ID
+			break
+		}
+	}
+	b.store.mu.RUnlock()
+	if id == "" {
+		b.outcomes[key] = writeOutcome{ID: sku, Err: errMemoryNotFound(sku)}
+		return
+	}
+	err := b.store.Update(ctx, id, map[string]interface{}{"stock": stock}, RefreshNone)
+	b.outcomes[key] = writeOutcome{ID: id, Err: err}
+}
+
+func (b *memoryBulkWriter) Wait(ctx context.Context) map[int]writeOutcome {
+	return b.outcomes
+}
+
+// mergeItem returns item with the fields in doc, by JSON name, set to
+// their values.
+func mergeItem(item schema.Item, doc map[string]interface{}) (schema.Item, error) {
+	raw, err := json.Marshal(item)
+	if err != nil {
+		return item, err
+	}
+	fields := map[string]interface{}{}
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return item, err
+	}
+	for field, value := range doc {
+		fields[field] = value
+	}
+	// Suggestions only matter to Elasticsearch.
+	delete(fields, "suggest_field")
+	if raw, err = json.Marshal(fields); err != nil {
+		return item, err
+	}
+	var updated schema.Item
+	if err := json.Unmarshal(raw, &updated); err != nil {
+		return item, err
+	}
+	updated.ID = item.ID
+	return updated, nil
+}
+
+// errMemoryNotFound is the error for a missing item, shaped like the one
+// Elasticsearch returns so elastic.IsNotFound reports true for it.
+func errMemoryNotFound(id string) error {
+	return &elastic.Error{Status: http.StatusNotFound, Details: &elastic.ErrorDetails{
+		Type:   "document_missing_exception",
+		Reason: fmt.Sprintf("[item][%s]: document missing", id),
+	}}
+}
+
+// copyItem returns a copy of item that shares no slices with it, so
+// callers can't change what's stored.
+func copyItem(item schema.Item) schema.Item {
+	item.Tags = append([]string(nil), item.Tags...)
+	return item
+}
+
+// sharesWord reports whether text and name have a word in common, ignoring
+// case.
+func sharesWord(text, name string) bool {
+	words := strings.Fields(strings.ToLower(name))
+	for _, word := range strings.Fields(strings.ToLower(text)) {
+		if containsString(words, word) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"gopkg.in/olivere/elastic.v6"
+	"html/template"
+	"invento-search/schema"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// pages serves the HTML pages. They only reach items through store, so
+// they can be served from a memoryStore without a cluster.
+type pages struct {
+	cfg       Config
+	store     ItemStore
+	templates *template.Template
+	breaker   *breaker
+	recent    *recentItems
+	popular   *searchStats
+	welcome   schema.Welcome
+}
+
+// landing serves the landing page with the search box.
+func (p *pages) landing(w http.ResponseWriter, r *http.Request) {
+	page := p.welcome
+	// Set welcome message name according to URL param
+	if username := r.FormValue("username"); username != "" {
+		page.Username = username
+	}
+	// The form searches with GET now, so results have a URL to share.
+	// Posting it still works for old pages and bookmarks.
+	if r.Method == "POST" {
+		if name := r.FormValue("name"); name != "" {
+			http.Redirect(w, r, "/search/?"+url.Values{"name": {name}}.Encode(), http.StatusSeeOther)
+			return
+		}
+	}
+
+	// The landing page works without Elasticsearch, it just doesn't
+	// list recent items then.
+	if ids := p.recent.ids(r); len(ids) > 0 && !p.breaker.isOpen() {
+		items, err := p.store.GetMany(r.Context(), ids)
+		if err != nil {
+			logf(r.Context(), "Getting recently viewed items: %v\n", err)
+		}
+		page.Recent = items
+	}
+
+	if err := p.templates.ExecuteTemplate(w, "landing-page.html", page); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// item shows an item.
+func (p *pages) item(w http.ResponseWriter, r *http.Request) {
+	var page schema.ItemPage
+
+	if id := r.FormValue("id"); id != "" {
+		// Get item with specified ID
+		item, err := p.store.Get(r.Context(), id)
+		if err != nil && !elastic.IsNotFound(err) {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err == nil {
+			page.Item = item
+			page.Found = true
+			p.recent.add(w, r, page.Item.ID)
+			if page.JSONLD, err = productJSONLD(r, p.cfg.PriceCurrency, page.Item); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		} else {
+			logf(r.Context(), "Document %s not found\n", id)
+		}
+	}
+
+	if !page.Found {
+		w.WriteHeader(http.StatusNotFound)
+	}
+	if err := p.templates.ExecuteTemplate(w, "item.html", page); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// create shows the create form and creates the item posted with it.
+func (p *pages) create(w http.ResponseWriter, r *http.Request) {
+	// New items start with one in stock.
+	page := schema.EditPage{Item: schema.Item{Stock: 1}}
+	if r.Method != "POST" {
+		if err := p.templates.ExecuteTemplate(w, "create.html", page); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	edit := applyItemForm(r.Form, page.Item)
+	item := edit.Item
+	item.SKU = strings.TrimSpace(r.FormValue("sku"))
+	if len(edit.Errors) > 0 {
+		// Show the form again with what was entered.
+		edit.Values["sku"] = item.SKU
+		page = schema.EditPage{Item: item, Errors: edit.Errors, Values: edit.Values}
+		w.WriteHeader(http.StatusBadRequest)
+		if err := p.templates.ExecuteTemplate(w, "create.html", page); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	// Refuse to create the same product twice when asked to check.
+	if r.FormValue("checkDuplicate") == "true" {
+		existing, found, err := p.store.FindDuplicate(r.Context(), item)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if found {
+			w.Header().Set("Location", "/items?id="+url.QueryEscape(existing.ID))
+			http.Error(w, "an item with this name and description already exists: /items?id="+url.QueryEscape(existing.ID), http.StatusConflict)
+			return
+		}
+	}
+
+	// Wait for the item to be searchable so the user finds it straight
+	// away.
+	id, err := p.store.Create(r.Context(), item, RefreshWaitFor)
+	if elastic.IsConflict(err) {
+		http.Error(w, "an item with SKU "+item.SKU+" already exists", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	logf(r.Context(), "Created item %s\n", id)
+
+	if err := p.templates.ExecuteTemplate(w, "create.html", page); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// edit shows the edit form of an item and applies the changes posted with
+// it.
+func (p *pages) edit(w http.ResponseWriter, r *http.Request) {
+	// Get item
+	var item schema.Item
+	id := r.FormValue("id")
+	found := false
+	if id != "" {
+		// Get item with specified ID
+		var err error
+		item, err = p.store.Get(r.Context(), id)
+		if err != nil && !elastic.IsNotFound(err) {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err == nil {
+			found = true
+		} else {
+			logf(r.Context(), "Document %s not found\n", id)
+		}
+	}
+
+	page := schema.EditPage{Item: item}
+	if r.Method == "POST" {
+		if !found {
+			http.NotFound(w, r)
+			return
+		}
+
+		// Apply every submitted field in a single update.
+		edit := applyItemForm(r.PostForm, item)
+		if len(edit.Errors) == 0 {
+			if err := p.store.Update(r.Context(), id, edit.Doc, RefreshWaitFor); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			http.Redirect(w, r, "/items?id="+id, http.StatusSeeOther)
+			return
+		}
+
+		// Show the form again with what was entered.
+		page = schema.EditPage{Item: edit.Item, Errors: edit.Errors, Values: edit.Values}
+		w.WriteHeader(http.StatusBadRequest)
+	}
+
+	if err := p.templates.ExecuteTemplate(w, "edit.html", page); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// delete deletes an item.
+func (p *pages) delete(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := r.FormValue("id")
+	if id == "" {
+		http.Error(w, "id is required", http.StatusBadRequest)
+		return
+	}
+
+	// Wait for the delete to be visible so the item is gone from search.
+	deleted, err := p.store.Delete(r.Context(), id, RefreshWaitFor)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !deleted {
+		http.NotFound(w, r)
+		return
+	}
+	logf(r.Context(), "Deleted item %s\n", id)
+
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// search shows the search results page.
+func (p *pages) search(w http.ResponseWriter, r *http.Request) {
+	var result schema.SearchResponse
+	params, err := parseSearchParams(p.cfg, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if params.HasQuery() {
+		result, err = p.store.Search(r.Context(), params)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		p.popular.record(searchTerm(params), result.Total)
+	}
+
+	if err := p.templates.ExecuteTemplate(w, "list.html", newListPage(r, params, result)); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
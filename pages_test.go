@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"invento-search/schema"
+	"invento-search/search"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// newTestPages returns the pages serving items from store.
+func newTestPages(t *testing.T, store ItemStore) *pages {
+	t.Helper()
+	cfg := testConfig(t)
+	templates, err := loadTemplates(cfg.TemplateDir, templateFuncs(cfg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &pages{
+		cfg:       cfg,
+		store:     store,
+		templates: templates,
+		breaker:   newBreaker(cfg.BreakerThreshold),
+		recent:    newRecentItems("test"),
+		popular:   newSearchStats(16, 100),
+		welcome:   schema.Welcome{Username: "Nakama"},
+	}
+}
+
+// postForm posts form to handler and returns the response.
+func postForm(handler http.HandlerFunc, path string, form url.Values) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+func TestCreateDuplicate(t *testing.T) {
+	store := newMemoryStore(nil)
+	id, err := store.Create(context.Background(), schema.Item{Name: "Monitor 24", Description: "Full HD", Stock: 1}, RefreshNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	site := newTestPages(t, store)
+	form := url.Values{"name": {"Monitor 24"}, "description": {"Full HD"}, "stock": {"2"}, "checkDuplicate": {"true"}}
+
+	w := postForm(site.create, "/create/", form)
+	if w.Code != http.StatusConflict {
+		t.Fatalf("duplicate create answered %d: %s", w.Code, w.Body)
+	}
+	if location := w.Header().Get("Location"); location != "/items?id="+id {
+		t.Errorf("duplicate create pointed to %q, want the existing item %s", location, id)
+	}
+
+	// Without asking to check, the same product is created again.
+	form.Del("checkDuplicate")
+	if w := postForm(site.create, "/create/", form); w.Code != http.StatusOK {
+		t.Fatalf("create answered %d: %s", w.Code, w.Body)
+	}
+	res, err := store.Search(context.Background(), search.Params{Name: "Monitor 24", Size: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Total != 2 {
+		t.Errorf("found %d items named Monitor 24, want 2", res.Total)
+	}
+}
+
+func TestItemLifecycle(t *testing.T) {
+	store := newMemoryStore(nil)
+	site := newTestPages(t, store)
+	get := func(handler http.HandlerFunc, path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+
+	form := url.Values{"sku": {"MON-24"}, "name": {"Monitor 24"}, "description": {"Full HD"}, "stock": {"2"}, "price": {"150"}}
+	if w := postForm(site.create, "/create/", form); w.Code != http.StatusOK {
+		t.Fatalf("create answered %d: %s", w.Code, w.Body)
+	}
+	// Items are stored under their SKU.
+	w := get(site.item, "/items?id=MON-24")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Monitor 24") {
+		t.Fatalf("item answered %d after create: %s", w.Code, w.Body)
+	}
+
+	form = url.Values{"name": {"Monitor 24 Pro"}, "stock": {"5"}}
+	w = postForm(site.edit, "/edit/?id=MON-24", form)
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/items?id=MON-24" {
+		t.Fatalf("edit answered %d to %q: %s", w.Code, w.Header().Get("Location"), w.Body)
+	}
+	item, err := store.Get(context.Background(), "MON-24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.Name != "Monitor 24 Pro" || item.Stock != 5 || item.Description != "Full HD" {
+		t.Errorf("edited item is %+v, want the new name and stock and the old description", item)
+	}
+
+	if w := postForm(site.delete, "/delete/", url.Values{"id": {"MON-24"}}); w.Code != http.StatusSeeOther {
+		t.Fatalf("delete answered %d: %s", w.Code, w.Body)
+	}
+	if w := get(site.item, "/items?id=MON-24"); w.Code != http.StatusNotFound {
+		t.Errorf("item answered %d after delete, want 404", w.Code)
+	}
+	if w := postForm(site.delete, "/delete/", url.Values{"id": {"MON-24"}}); w.Code != http.StatusNotFound {
+		t.Errorf("deleting a missing item answered %d, want 404", w.Code)
+	}
+	if w := postForm(site.edit, "/edit/?id=MON-24", form); w.Code != http.StatusNotFound {
+		t.Errorf("editing a missing item answered %d, want 404", w.Code)
+	}
+
+	w = get(site.delete, "/delete/?id=MON-24")
+	if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != "POST" {
+		t.Errorf("GET /delete/ answered %d with Allow %q, want 405 and POST", w.Code, w.Header().Get("Allow"))
+	}
+}
+
+func TestItemFormErrors(t *testing.T) {
+	store := newMemoryStore(nil)
+	if _, err := store.Create(context.Background(), schema.Item{ID: "monitor-24", Name: "Monitor 24", Stock: 1, Price: 150}, RefreshNone); err != nil {
+		t.Fatal(err)
+	}
+	site := newTestPages(t, store)
+
+	for _, tt := range []struct {
+		field, value, msg string
+	}{
+		{"stock", "lots", "Stock must be a whole number"},
+		{"stock", "-3", "Stock can&#39;t be negative"},
+		{"stock", "", "Stock is required"},
+		{"price", "cheap", "Price must be a number"},
+		{"price", "-1.5", "Price can&#39;t be negative"},
+		{"price", "NaN", "Price must be a number"},
+		{"price", "", "Price is required"},
+	} {
+		form := url.Values{"name": {"Monitor 24 Pro"}, "sku": {"MON-24"}, "stock": {"2"}, "price": {"99"}}
+		form.Set(tt.field, tt.value)
+		for path, handler := range map[string]http.HandlerFunc{"/create/": site.create, "/edit/?id=monitor-24": site.edit} {
+			w := postForm(handler, path, form)
+			body := w.Body.String()
+			if w.Code != http.StatusBadRequest || !strings.Contains(body, tt.msg) {
+				t.Errorf("%s with %s=%q answered %d without %q: %s", path, tt.field, tt.value, w.Code, tt.msg, body)
+				continue
+			}
+			// The form comes back as it was filled in.
+			if tt.value != "" && !strings.Contains(body, `name="`+tt.field+`" value="`+tt.value+`"`) {
+				t.Errorf("%s with %s=%q lost the value entered: %s", path, tt.field, tt.value, body)
+			}
+			if !strings.Contains(body, `value="Monitor 24 Pro"`) {
+				t.Errorf("%s with %s=%q lost the name entered: %s", path, tt.field, tt.value, body)
+			}
+		}
+	}
+
+	// Nothing was written.
+	if item, err := store.Get(context.Background(), "monitor-24"); err != nil || item.Name != "Monitor 24" || item.Stock != 1 {
+		t.Errorf("item is %+v (%v) after invalid edits", item, err)
+	}
+	if _, err := store.Get(context.Background(), "MON-24"); err == nil {
+		t.Error("invalid create stored the item")
+	}
+}
+
+// documentES keeps documents like an index does: writes only show up in
+// searches once refreshed, which writes asking for refresh=wait_for or
+// true do straight away. Searches find the visible documents whose name
+// appears in the query.
+type documentES struct {
+	docs    map[string]map[string]interface{}
+	visible map[string]map[string]interface{}
+}
+
+func newDocumentES() *documentES {
+	return &documentES{docs: map[string]map[string]interface{}{}, visible: map[string]map[string]interface{}{}}
+}
+
+func (es *documentES) handle(req esRequest) (int, interface{}) {
+	id := strings.TrimSuffix(strings.TrimPrefix(req.Path, "/items/item/"), "/_update")
+	result := func(status int, result string) (int, interface{}) {
+		if refresh := req.Query.Get("refresh"); refresh == "wait_for" || refresh == "true" {
+			es.visible = map[string]map[string]interface{}{}
+			for id, doc := range es.docs {
+				es.visible[id] = doc
+			}
+		}
+		return status, map[string]interface{}{"_index": "items", "_type": "item", "_id": id, "_version": 1, "result": result}
+	}
+	doc, found := es.docs[id]
+	switch {
+	case strings.HasSuffix(req.Path, "/_search"):
+		hits := map[string]interface{}{}
+		for id, doc := range es.visible {
+			if strings.Contains(req.Body, fmt.Sprintf("%q", doc["name"])) {
+				hits[id] = doc
+			}
+		}
+		return http.StatusOK, searchHits(hits)
+	case req.Method == "PUT" && found:
+		return http.StatusConflict, map[string]interface{}{"status": 409, "error": map[string]string{"type": "version_conflict_engine_exception"}}
+	case req.Method == "PUT":
+		json.Unmarshal([]byte(req.Body), &doc)
+		es.docs[id] = doc
+		return result(http.StatusCreated, "created")
+	case strings.HasSuffix(req.Path, "/_update") && found:
+		var update struct {
+			Doc map[string]interface{} `json:"doc"`
+		}
+		json.Unmarshal([]byte(req.Body), &update)
+		merged := map[string]interface{}{}
+		for k, v := range doc {
+			merged[k] = v
+		}
+		for k, v := range update.Doc {
+			merged[k] = v
+		}
+		es.docs[id] = merged
+		return result(http.StatusOK, "updated")
+	case req.Method == "GET" && found:
+		return http.StatusOK, map[string]interface{}{"_index": "items", "_type": "item", "_id": id, "found": true, "_source": doc}
+	case req.Method == "DELETE" && found:
+		delete(es.docs, id)
+		return result(http.StatusOK, "deleted")
+	case req.Method == "GET":
+		return http.StatusNotFound, esNotFound(id)
+	case req.Method == "DELETE":
+		return http.StatusNotFound, map[string]interface{}{"_index": "items", "_type": "item", "_id": id, "result": "not_found"}
+	}
+	return http.StatusNotFound, map[string]interface{}{"status": 404, "error": map[string]string{"type": "document_missing_exception"}}
+}
+
+// TestItemLifecycleES runs TestItemLifecycle's steps on esStore, checking
+// that every write waits for a refresh, so the search page shows it
+// straight after.
+func TestItemLifecycleES(t *testing.T) {
+	documents := newDocumentES()
+	client, es := newFakeES(t, documents.handle)
+	site := newTestPages(t, newESStore(testConfig(t), client, nil))
+	searchPage := func(name string) string {
+		w := httptest.NewRecorder()
+		site.search(w, httptest.NewRequest("GET", "/search/?"+url.Values{"name": {name}}.Encode(), nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("searching %q answered %d: %s", name, w.Code, w.Body)
+		}
+		return w.Body.String()
+	}
+	assertWaited := func(method, path string) {
+		t.Helper()
+		reqs := es.requestsTo(method, path)
+		if len(reqs) == 0 || reqs[len(reqs)-1].Query.Get("refresh") != "wait_for" {
+			t.Errorf("%s %s sent with %v, want refresh=wait_for", method, path, reqs)
+		}
+	}
+
+	form := url.Values{"sku": {"MON-24"}, "name": {"Monitor 24"}, "description": {"Full HD"}, "stock": {"2"}, "price": {"150"}}
+	if w := postForm(site.create, "/create/", form); w.Code != http.StatusOK {
+		t.Fatalf("create answered %d: %s", w.Code, w.Body)
+	}
+	assertWaited("PUT", "/items/item/MON-24")
+	if !strings.Contains(searchPage("Monitor 24"), "/items?id=MON-24") {
+		t.Error("the search page doesn't list the item just created")
+	}
+
+	form = url.Values{"name": {"Monitor 24 Pro"}, "stock": {"5"}}
+	if w := postForm(site.edit, "/edit/?id=MON-24", form); w.Code != http.StatusSeeOther {
+		t.Fatalf("edit answered %d: %s", w.Code, w.Body)
+	}
+	assertWaited("POST", "/items/item/MON-24/_update")
+	if !strings.Contains(searchPage("Monitor 24 Pro"), "/items?id=MON-24") {
+		t.Error("the search page doesn't find the item by its new name")
+	}
+	if strings.Contains(searchPage("Monitor 24"), "/items?id=MON-24") {
+		t.Error("the search page still finds the item by its old name")
+	}
+
+	if w := postForm(site.delete, "/delete/", url.Values{"id": {"MON-24"}}); w.Code != http.StatusSeeOther {
+		t.Fatalf("delete answered %d: %s", w.Code, w.Body)
+	}
+	assertWaited("DELETE", "/items/item/MON-24")
+	if strings.Contains(searchPage("Monitor 24 Pro"), "/items?id=MON-24") {
+		t.Error("the search page still lists the deleted item")
+	}
+	if searches := es.requestsTo("POST", "/items/_search"); len(searches) != 4 {
+		t.Errorf("searched %d times, want 4", len(searches))
+	}
+
+	if w := postForm(site.delete, "/delete/", url.Values{"id": {"MON-24"}}); w.Code != http.StatusNotFound {
+		t.Errorf("deleting a missing item answered %d, want 404", w.Code)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"invento-search/search"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// searchRecord is one search waiting to be counted.
+type searchRecord struct {
+	term    string
+	results int64
+}
+
+// termStats is how often a term was searched for.
+type termStats struct {
+	Term        string `json:"term"`
+	Count       int64  `json:"count"`
+	LastResults int64  `json:"last_results"`
+}
+
+// searchStats counts search terms in memory. Searches are recorded through
+// a buffered channel so counting never holds up a search response.
+//
+// Terms are whatever users type, so only maxTerms distinct ones are kept.
+// A new term beyond that replaces the least searched one, the one searched
+// longest ago among those.
+type searchStats struct {
+	records  chan searchRecord
+	maxTerms int
+
+	mu    sync.Mutex
+	terms map[string]*termStats
+	// seen is when each term was last searched, by the number of searches
+	// counted by then.
+	seen     map[string]uint64
+	searches uint64
+}
+
+// newSearchStats starts a counter that buffers up to size pending records
+// and keeps up to maxTerms terms.
+func newSearchStats(size, maxTerms int) *searchStats {
+	s := &searchStats{
+		records:  make(chan searchRecord, size),
+		maxTerms: maxTerms,
+		terms:    make(map[string]*termStats),
+		seen:     make(map[string]uint64),
+	}
+	go s.run()
+	return s
+}
+
+func (s *searchStats) run() {
+	for rec := range s.records {
+		s.count(rec)
+	}
+}
+
+// count adds rec to the counts.
+func (s *searchStats) count(rec searchRecord) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats, ok := s.terms[rec.term]
+	if !ok {
+		if len(s.terms) >= s.maxTerms {
+			s.evict()
+		}
+		stats = &termStats{Term: rec.term}
+		s.terms[rec.term] = stats
+	}
+	s.searches++
+	s.seen[rec.term] = s.searches
+	stats.Count++
+	stats.LastResults = rec.results
+}
+
+// evict drops the least searched term, the one searched longest ago among
+// those. It's a scan, but only runs for new terms once the counts are full.
+func (s *searchStats) evict() {
+	var victim string
+	for term, stats := range s.terms {
+		if victim == "" {
+			victim = term
+			continue
+		}
+		least := s.terms[victim]
+		if stats.Count < least.Count || (stats.Count == least.Count && s.seen[term] < s.seen[victim]) {
+			victim = term
+		}
+	}
+	delete(s.terms, victim)
+	delete(s.seen, victim)
+}
+
+// record counts a search for term. Empty terms are ignored, and the record
+// is dropped if the buffer is full.
+func (s *searchStats) record(term string, results int64) {
+	term = strings.ToLower(strings.TrimSpace(term))
+	if term == "" {
+		return
+	}
+	select {
+	case s.records <- searchRecord{term: term, results: results}:
+	default:
+	}
+}
+
+// top returns the n most searched terms, most frequent first.
+func (s *searchStats) top(n int) []termStats {
+	s.mu.Lock()
+	all := make([]termStats, 0, len(s.terms))
+	for _, stats := range s.terms {
+		all = append(all, *stats)
+	}
+	s.mu.Unlock()
+
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].Count != all[j].Count {
+			return all[i].Count > all[j].Count
+		}
+		return all[i].Term < all[j].Term
+	})
+	if len(all) > n {
+		all = all[:n]
+	}
+	return all
+}
+
+// searchTerm is the term a search is counted under.
+func searchTerm(params search.Params) string {
+	switch {
+	case params.Query != "":
+		return params.Query
+	case params.Name != "":
+		return params.Name
+	default:
+		return params.Wildcard
+	}
+}
+
+// popularSearchesHandler returns the top n search terms, 10 by default.
+func popularSearchesHandler(stats *searchStats) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		n := 10
+		if v := r.FormValue("n"); v != "" {
+			parsed, err := strconv.Atoi(v)
+			if err != nil || parsed <= 0 {
+				http.Error(w, "n must be a positive number", http.StatusBadRequest)
+				return
+			}
+			n = parsed
+		}
+		writeJSON(w, r, http.StatusOK, stats.top(n))
+	}
+}
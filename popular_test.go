@@ -0,0 +1,36 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSearchStatsCap(t *testing.T) {
+	s := &searchStats{maxTerms: 3, terms: map[string]*termStats{}, seen: map[string]uint64{}}
+	for _, term := range []string{"desk", "desk", "chair", "chair", "lamp", "mug"} {
+		s.count(searchRecord{term: term})
+	}
+	// lamp and mug were each searched once, lamp longer ago, so mug took
+	// its place.
+	terms := func() []string {
+		var terms []string
+		for _, stats := range s.top(10) {
+			terms = append(terms, stats.Term)
+		}
+		return terms
+	}
+	if want := []string{"chair", "desk", "mug"}; !reflect.DeepEqual(terms(), want) {
+		t.Errorf("counting %v, want %v", terms(), want)
+	}
+
+	// Terms searched more often stay however many new ones come along.
+	for _, term := range []string{"pen", "cup", "bin", "box"} {
+		s.count(searchRecord{term: term})
+	}
+	if want := []string{"chair", "desk", "box"}; !reflect.DeepEqual(terms(), want) {
+		t.Errorf("counting %v, want %v", terms(), want)
+	}
+	if len(s.terms) != 3 || len(s.seen) != 3 {
+		t.Errorf("keeping %d terms and %d last searches, want 3", len(s.terms), len(s.seen))
+	}
+}
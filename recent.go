@@ -0,0 +1,95 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// recentCookie holds the ids of the items a visitor viewed last.
+	recentCookie = "recently_viewed"
+	// maxRecentItems caps how many ids the cookie keeps.
+	maxRecentItems = 10
+)
+
+// recentItems tracks the items a visitor recently viewed in a cookie,
+// newest first. The cookie is signed, so it only ever holds ids this server
+// put there.
+type recentItems struct {
+	key []byte
+}
+
+// newRecentItems signs cookies with secret. Without a secret a random key
+// is used, and cookies from before a restart are ignored.
+func newRecentItems(secret string) *recentItems {
+	key := []byte(secret)
+	if secret == "" {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			panic(err)
+		}
+	}
+	return &recentItems{key: key}
+}
+
+// ids returns the ids in the request's cookie, newest first. A missing or
+// tampered cookie holds none.
+func (ri *recentItems) ids(r *http.Request) []string {
+	cookie, err := r.Cookie(recentCookie)
+	if err != nil {
+		return nil
+	}
+	dot := strings.IndexByte(cookie.Value, '.')
+	if dot < 0 {
+		return nil
+	}
+	payload, sig := cookie.Value[:dot], cookie.Value[dot+1:]
+	if !hmac.Equal([]byte(sig), []byte(ri.sign(payload))) {
+		return nil
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil
+	}
+	var ids []string
+	if err := json.Unmarshal(raw, &ids); err != nil {
+		return nil
+	}
+	return ids
+}
+
+// add moves id to the front of the cookie, dropping the oldest ids beyond
+// maxRecentItems. It has to be called before the response is written.
+func (ri *recentItems) add(w http.ResponseWriter, r *http.Request, id string) {
+	ids := []string{id}
+	for _, old := range ri.ids(r) {
+		if old != id && len(ids) < maxRecentItems {
+			ids = append(ids, old)
+		}
+	}
+	raw, err := json.Marshal(ids)
+	if err != nil {
+		return
+	}
+	payload := base64.RawURLEncoding.EncodeToString(raw)
+	http.SetCookie(w, &http.Cookie{
+		Name:     recentCookie,
+		Value:    payload + "." + ri.sign(payload),
+		Path:     "/",
+		Expires:  time.Now().Add(30 * 24 * time.Hour),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func (ri *recentItems) sign(payload string) string {
+	mac := hmac.New(sha256.New, ri.key)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
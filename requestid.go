@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// requestIDHeader carries the request id in and out.
+const requestIDHeader = "X-Request-ID"
+
+// requestIDKey is the context key of the request id.
+type requestIDKey struct{}
+
+// withRequestID gives every request an id, the incoming X-Request-ID if it
+// has a usable one and a random one otherwise. The id is echoed in the
+// response, stored in the request context for logf and Elasticsearch, and
+// logged along with the request once it's served.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		ctx := contextWithRequestID(r.Context(), id)
+
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+		logf(ctx, "%s %s %d %s\n", r.Method, r.URL.Path, rec.status, time.Since(start).Round(time.Millisecond))
+	})
+}
+
+// contextWithRequestID returns a copy of ctx carrying the request id.
+func contextWithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// requestID returns the id of the request ctx belongs to, if any.
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// logf prints a log line, prefixed with the request id when ctx has one.
+func logf(ctx context.Context, format string, args ...interface{}) {
+	if id := requestID(ctx); id != "" {
+		format = "[" + id + "] " + format
+	}
+	fmt.Printf(format, args...)
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// validRequestID accepts ids of up to 128 printable ASCII characters, so a
+// client can't smuggle line breaks into the logs.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// statusRecorder remembers the status code written to a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// opaqueIDTransport tags requests to Elasticsearch with the id of the
+// request they're made for, as X-Opaque-Id, so they can be matched up in
+// its slow logs and task list.
+type opaqueIDTransport struct {
+	next http.RoundTripper
+}
+
+func (t *opaqueIDTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if id := requestID(req.Context()); id != "" {
+		req = req.Clone(req.Context())
+		req.Header.Set("X-Opaque-Id", id)
+	}
+	return t.next.RoundTrip(req)
+}
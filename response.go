@@ -0,0 +1,20 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// writeJSON writes v as a JSON response with the given status code. The
+// output is compact unless the request asks for pretty=true.
+func writeJSON(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	if r.FormValue("pretty") == "true" {
+		enc.SetIndent("", "  ")
+	}
+	if err := enc.Encode(v); err != nil {
+		logf(r.Context(), "Writing JSON response failed: %v\n", err)
+	}
+}
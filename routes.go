@@ -0,0 +1,76 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"sort"
+)
+
+// route describes an endpoint for the /api index.
+type route struct {
+	Path        string   `json:"path"`
+	Methods     []string `json:"methods"`
+	Params      []string `json:"params,omitempty"`
+	Description string   `json:"description"`
+	// Admin routes need the admin token.
+	Admin bool `json:"admin,omitempty"`
+	// Offline routes don't use Elasticsearch, so they're still served
+	// while it's down.
+	Offline bool `json:"-"`
+}
+
+// routeTable registers handlers and remembers them so /api can list what
+// is actually served.
+type routeTable struct {
+	adminToken  string
+	esBreaker   *breaker
+	maintenance *template.Template
+	routes      []route
+}
+
+func newRouteTable(adminToken string, esBreaker *breaker, maintenance *template.Template) *routeTable {
+	return &routeTable{adminToken: adminToken, esBreaker: esBreaker, maintenance: maintenance}
+}
+
+// handle registers handler for the route. Admin routes are wrapped in
+// requireAdmin, and routes that aren't Offline are guarded by the
+// Elasticsearch breaker.
+func (t *routeTable) handle(rt route, handler http.Handler) {
+	if !rt.Offline {
+		handler = t.esBreaker.guard(t.maintenance, handler)
+	}
+	if rt.Admin {
+		handler = requireAdmin(t.adminToken, handler)
+	}
+	http.Handle(rt.Path, handler)
+	t.routes = append(t.routes, rt)
+}
+
+func (t *routeTable) handleFunc(rt route, handler func(http.ResponseWriter, *http.Request)) {
+	t.handle(rt, http.HandlerFunc(handler))
+}
+
+// indexHandler lists the registered routes as JSON, sorted by path.
+func (t *routeTable) indexHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		routes := append([]route{}, t.routes...)
+		sort.Slice(routes, func(i, j int) bool { return routes[i].Path < routes[j].Path })
+		writeJSON(w, r, http.StatusOK, routes)
+	}
+}
+
+// HTTP methods used in the route table.
+var (
+	getOnly    = []string{"GET"}
+	postOnly   = []string{"POST"}
+	putOnly    = []string{"PUT"}
+	getAndPost = []string{"GET", "POST"}
+)
+
+// searchParams are the params understood by parseSearchParams.
+var searchParams = []string{"name", "q", "wildcard", "refine", "require", "prefer", "brand", "tags", "excludeTags", "excludeName", "from", "size", "includeArchived", "inStock", "recency", "mode", "searchNotes", "operators", "collapse", "lang", "score"}
+
+// withParams returns a copy of params with extra appended.
+func withParams(params []string, extra ...string) []string {
+	return append(append([]string{}, params...), extra...)
+}
@@ -0,0 +1,150 @@
+package schema
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Mapping is the index body used when creating the items index.
+const Mapping = `
+{
+	"settings":{
+		"number_of_shards": 1,
+		"number_of_replicas": 0,
+		"analysis":{
+			"filter":{
+				"instant_2gram":{
+					"type":"shingle",
+					"min_shingle_size":2,
+					"max_shingle_size":2,
+					"output_unigrams":false
+				},
+				"instant_3gram":{
+					"type":"shingle",
+					"min_shingle_size":3,
+					"max_shingle_size":3,
+					"output_unigrams":false
+				},
+				"instant_prefix":{
+					"type":"edge_ngram",
+					"min_gram":1,
+					"max_gram":20
+				}
+			},
+			"analyzer":{
+				"instant_2gram":{
+					"type":"custom",
+					"tokenizer":"standard",
+					"filter":["lowercase","instant_2gram"]
+				},
+				"instant_3gram":{
+					"type":"custom",
+					"tokenizer":"standard",
+					"filter":["lowercase","instant_3gram"]
+				},
+				"instant_prefix":{
+					"type":"custom",
+					"tokenizer":"standard",
+					"filter":["lowercase","instant_prefix"]
+				}
+			}
+		}
+	},
+	"mappings":{
+		"item":{
+			"properties":{
+				"id": {
+					"type":"text"
+				},
+				"name":{
+					"type":"text",
+					"fields":{
+						"raw":{
+							"type":"keyword"
+						},
+						"2gram":{
+							"type":"text",
+							"analyzer":"instant_2gram"
+						},
+						"3gram":{
+							"type":"text",
+							"analyzer":"instant_3gram"
+						},
+						"prefix":{
+							"type":"text",
+							"analyzer":"instant_prefix",
+							"search_analyzer":"standard"
+						}
+					}
+				},
+				"sku":{
+					"type":"keyword"
+				},
+				"description":{
+					"type":"text",
+					"store": true,
+					"fields":{
+						"en":{
+							"type":"text",
+							"analyzer":"english"
+						},
+						"id":{
+							"type":"text",
+							"analyzer":"indonesian"
+						}
+					}
+				},
+				"stock":{
+					"type":"long"
+				},
+				"brand":{
+					"type":"keyword"
+				},
+				"category":{
+					"type":"keyword"
+				},
+				"price":{
+					"type":"scaled_float",
+					"scaling_factor": 100
+				},
+				"notes":{
+					"type":"text",
+					"analyzer":"english"
+				},
+				"image":{
+					"type":"keyword"
+				},
+				"created":{
+					"type":"date"
+				},
+				"tags":{
+					"type":"keyword"
+				},
+				"location":{
+					"type":"geo_point"
+				},
+				"suggest_field":{
+					"type":"completion"
+				}
+			}
+		}
+	}
+}`
+
+// Properties returns the item properties of Mapping, keyed by field.
+func Properties() (map[string]map[string]interface{}, error) {
+	var mapping struct {
+		Mappings map[string]struct {
+			Properties map[string]map[string]interface{} `json:"properties"`
+		} `json:"mappings"`
+	}
+	if err := json.Unmarshal([]byte(Mapping), &mapping); err != nil {
+		return nil, fmt.Errorf("mapping is not valid JSON: %v", err)
+	}
+	item, ok := mapping.Mappings["item"]
+	if !ok {
+		return nil, errors.New("mapping has no item type")
+	}
+	return item.Properties, nil
+}
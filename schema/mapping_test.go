@@ -0,0 +1,28 @@
+package schema
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestMappingMatchesItem checks that Mapping is valid JSON and maps every
+// field Item is serialized with, so drift between the two shows up here
+// rather than as unmapped, dynamically typed fields.
+func TestMappingMatchesItem(t *testing.T) {
+	properties, err := Properties()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	typ := reflect.TypeOf(Item{})
+	for i := 0; i < typ.NumField(); i++ {
+		name := strings.Split(typ.Field(i).Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		if _, ok := properties[name]; !ok {
+			t.Errorf("mapping has no property for item field %s", name)
+		}
+	}
+}
@@ -2,19 +2,30 @@ package schema
 
 import (
 	"gopkg.in/olivere/elastic.v6"
+	"html/template"
+	"net/url"
 	"time"
 )
 
 // Welcome message
 type Welcome struct {
 	Username string
+	// Recent are the items the visitor viewed last, newest first.
+	Recent []Item
 }
 
 // Item is a structure used for serializing/deserializing data in Elasticsearch.
 type Item struct {
+	// ID is the document id. It's filled in when reading and not stored.
+	ID          string                `json:"id,omitempty"`
 	Name        string                `json:"name"`
+	SKU         string                `json:"sku,omitempty"`
 	Description string                `json:"description"`
 	Stock       int                   `json:"stock"`
+	Brand       string                `json:"brand,omitempty"`
+	Category    string                `json:"category,omitempty"`
+	Price       float64               `json:"price,omitempty"`
+	Notes       string                `json:"notes,omitempty"`
 	Image       string                `json:"image,omitempty"`
 	Created     time.Time             `json:"created,omitempty"`
 	Tags        []string              `json:"tags,omitempty"`
@@ -25,5 +36,126 @@ type Item struct {
 // Response for search page
 type SearchResponse struct {
 	Item    []Item `json:"item"`
-	Message string `json:"string"`
+	Total   int64  `json:"total"`
+	Message string `json:"message,omitempty"`
+	// Groups is roughly how many names matched when results are collapsed
+	// by name, and Variants how many items each shown name stands for.
+	Groups   int64            `json:"groups,omitempty"`
+	Variants map[string]int64 `json:"variants,omitempty"`
+	// Brands counts the matching items per brand.
+	Brands []BrandCount `json:"brands,omitempty"`
+	// TimedOut means the search hit its timeout and the results may be
+	// partial.
+	TimedOut bool `json:"timed_out,omitempty"`
+	// FailedShards is how many shards failed to answer. The results only
+	// cover the rest, and Warning says so.
+	FailedShards int    `json:"failed_shards,omitempty"`
+	Warning      string `json:"warning,omitempty"`
+	// Degraded means the search failed and the results are those of a
+	// simplified search instead, see search.Params.Fallback.
+	Degraded bool `json:"degraded,omitempty"`
+	// Meta is how the search went, for monitoring.
+	Meta SearchMeta `json:"meta"`
+	// Debug is only filled in when asked for.
+	Debug *SearchDebug `json:"debug,omitempty"`
+}
+
+// SearchMeta reports how long a search took and how its shards fared,
+// as Elasticsearch returned it.
+type SearchMeta struct {
+	// TookMillis is how long Elasticsearch spent on the search.
+	TookMillis int64        `json:"took_ms"`
+	TimedOut   bool         `json:"timed_out"`
+	Shards     SearchShards `json:"shards"`
+}
+
+// SearchShards counts the shards a search ran on.
+type SearchShards struct {
+	Total      int `json:"total"`
+	Successful int `json:"successful"`
+	Skipped    int `json:"skipped"`
+	Failed     int `json:"failed"`
+}
+
+// BrandCount is how many matching items carry a brand.
+type BrandCount struct {
+	Brand string `json:"brand"`
+	Count int64  `json:"count"`
+}
+
+// BrandFacet links to the current search narrowed to a brand.
+type BrandFacet struct {
+	Brand string
+	Count int64
+	URL   string
+}
+
+// SearchDebug shows how a search was run.
+type SearchDebug struct {
+	Query  interface{} `json:"query"`
+	Boosts []string    `json:"boosts"`
+	// Require and Prefer are the required and optional clauses.
+	Require []string `json:"require,omitempty"`
+	Prefer  []string `json:"prefer,omitempty"`
+	// Scored says whether hits were scored. Filter-only searches aren't,
+	// and ScoredTookMillis is how long the same search takes with scoring,
+	// to compare with TookMillis.
+	Scored           bool  `json:"scored"`
+	TookMillis       int64 `json:"took_ms"`
+	ScoredTookMillis int64 `json:"scored_took_ms,omitempty"`
+}
+
+// Breadcrumb is a search refinement shown above the results.
+type Breadcrumb struct {
+	Label     string
+	RemoveURL string
+}
+
+// List page showing search results
+type ListPage struct {
+	Items       []Item
+	Refinements []Breadcrumb
+	// Query holds the current search so it can be refined further.
+	Query url.Values
+	// Warning says when the results may be incomplete.
+	Warning string
+	// Variants counts the items per name when results are collapsed.
+	Variants map[string]int64
+	// Brands narrow the results to one brand.
+	Brands []BrandFacet
+	// Pagination links to the other pages of results.
+	Pagination Pagination
+}
+
+// Pagination describes the pages of a search's results. Pages are numbered
+// from 1.
+type Pagination struct {
+	CurrentPage int
+	TotalPages  int
+	HasPrev     bool
+	HasNext     bool
+	// PageNumbers are the pages to link to, a window around the current
+	// page. It's empty when there's only one page.
+	PageNumbers []int
+	// Size is the number of results per page.
+	Size int
+}
+
+// Item page. Found is false when the requested item doesn't exist.
+type ItemPage struct {
+	Item  Item
+	Found bool
+	// JSONLD is the item as schema.org Product markup, already escaped
+	// for a script element.
+	JSONLD template.JS
+}
+
+// Edit page for an item, also used for the create form
+type EditPage struct {
+	Item Item
+	// Errors maps form fields to what's wrong with them.
+	Errors map[string]string
+	// Values holds the text entered per field when the form is shown
+	// again, so invalid input isn't lost.
+	Values map[string]string
 }
@@ -0,0 +1,491 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gopkg.in/olivere/elastic.v6"
+	"invento-search/schema"
+	"invento-search/search"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// errFilterRequired is returned by requireFilter for searches that match
+// every item.
+var errFilterRequired = errors.New("this would match every item, give a filter such as q, name, brand or tags, or pass confirm=true to go ahead anyway")
+
+// requireFilter refuses searches that match every item unless the request
+// is confirmed, for endpoints where running on the whole index by accident
+// is expensive or destructive.
+func requireFilter(r *http.Request, params search.Params) error {
+	if params.Filtered() || confirmed(r) {
+		return nil
+	}
+	return errFilterRequired
+}
+
+// confirmed reports whether the request passes confirm=true, to go ahead
+// with an operation on the whole index.
+func confirmed(r *http.Request) bool {
+	return r.FormValue("confirm") == "true"
+}
+
+// maxBrandFacets caps how many brands a search counts items for.
+const maxBrandFacets = 20
+
+// searchItems runs the search described by params and decodes the hits,
+// counting the matching items per brand.
+func searchItems(ctx context.Context, cfg Config, client *elastic.Client, params search.Params) (schema.SearchResponse, error) {
+	query := search.BuildQuery(params)
+	service := client.Search().
+		// The archive index may not exist yet, so skip it rather than fail.
+		Index(searchIndices(cfg, params)...).
+		IgnoreUnavailable(true).
+		Timeout(esDuration(cfg.SearchTimeout)).
+		Query(query).
+		Aggregation("brands", elastic.NewTermsAggregation().Field("brand").Size(maxBrandFacets)).
+		TrackTotalHits(true)
+	// Rank scored searches by relevance so the field boosts count, and
+	// recency searches so newer items come first.
+	if params.Scored() {
+		service = service.Sort("_score", false)
+	}
+	if params.Collapse {
+		// The inner hits only count the variants, they aren't fetched.
+		service = service.
+			Collapse(elastic.NewCollapseBuilder("name.raw").InnerHit(elastic.NewInnerHit().Name("variants").Size(0))).
+			Aggregation("groups", elastic.NewCardinalityAggregation().Field("name.raw"))
+	}
+	start := time.Now()
+	searchResult, err := service.
+		Sort("name.raw", true).
+		From(params.From).Size(params.Size).
+		Do(ctx)
+	if err != nil {
+		return schema.SearchResponse{}, err
+	}
+	logSlowSearch(ctx, cfg, params, query, time.Since(start), searchResult.TookInMillis)
+
+	response := schema.SearchResponse{Total: searchResult.Hits.TotalHits, TimedOut: searchResult.TimedOut}
+	response.Meta = schema.SearchMeta{TookMillis: searchResult.TookInMillis, TimedOut: searchResult.TimedOut}
+	if shards := searchResult.Shards; shards != nil {
+		response.Meta.Shards = schema.SearchShards{Total: shards.Total, Successful: shards.Successful, Skipped: shards.Skipped, Failed: shards.Failed}
+	}
+	if searchResult.TimedOut {
+		logf(ctx, "Search timed out after %s, results are partial\n", cfg.SearchTimeout)
+	}
+	if shards := searchResult.Shards; shards != nil && shards.Failed > 0 {
+		response.FailedShards = shards.Failed
+		response.Warning = fmt.Sprintf("%d of %d shards failed, results may be incomplete", shards.Failed, shards.Total)
+		for _, f := range shards.Failures {
+			logf(ctx, "Search failed on shard %d of %s: %v\n", f.Shard, f.Index, f.Reason["reason"])
+		}
+	}
+	if agg, found := searchResult.Aggregations.Cardinality("groups"); found && agg.Value != nil {
+		response.Groups = int64(*agg.Value)
+	}
+	if agg, found := searchResult.Aggregations.Terms("brands"); found {
+		for _, bucket := range agg.Buckets {
+			if brand, ok := bucket.Key.(string); ok {
+				response.Brands = append(response.Brands, schema.BrandCount{Brand: brand, Count: bucket.DocCount})
+			}
+		}
+	}
+	if searchResult.Hits.TotalHits == 0 {
+		logf(ctx, "Found no items\n")
+		response.Message = "Found no items"
+		return response, nil
+	}
+	for _, hit := range searchResult.Hits.Hits {
+		t, err := decodeItemSource(hit.Source, hit.Id)
+		if err != nil {
+			return schema.SearchResponse{}, err
+		}
+
+		// Work with item
+		logf(ctx, "Item named %s: %s\n", t.Name, t.Description)
+		response.Item = append(response.Item, t)
+		if variants, ok := hit.InnerHits["variants"]; ok && variants.Hits != nil {
+			if response.Variants == nil {
+				response.Variants = map[string]int64{}
+			}
+			response.Variants[t.Name] = variants.Hits.TotalHits
+		}
+	}
+	return response, nil
+}
+
+// degradedWarning is shown with the results of a fallback search.
+const degradedWarning = "This search couldn't be run as given, showing the items matching its name and text instead"
+
+// searchWithFallback runs searchItems, and if Elasticsearch rejects the
+// search as a bad request, such as a clause on a field it can't be applied
+// to, retries with the simplified fallback search and flags the results as
+// degraded. Other errors, and a failing fallback, are returned as they are.
+func searchWithFallback(ctx context.Context, cfg Config, client *elastic.Client, params search.Params) (schema.SearchResponse, error) {
+	response, err := searchItems(ctx, cfg, client, params)
+	if !elastic.IsStatusCode(err, http.StatusBadRequest) {
+		return response, err
+	}
+	logf(ctx, "Search failed, retrying with the fallback search: %s\n", esErrorReason(err))
+	fallback, fallbackErr := searchItems(ctx, cfg, client, params.Fallback())
+	if fallbackErr != nil {
+		return response, err
+	}
+	fallback.Degraded = true
+	fallback.Warning = degradedWarning
+	return fallback, nil
+}
+
+// esDuration formats d as an Elasticsearch time value.
+func esDuration(d time.Duration) string {
+	return strconv.FormatInt(d.Milliseconds(), 10) + "ms"
+}
+
+// apiSearchHandler serves search results as JSON.
+func apiSearchHandler(cfg Config, store ItemStore, popular *searchStats) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		params, err := parseSearchParams(cfg, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		result, err := store.Search(r.Context(), params)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		popular.record(searchTerm(params), result.Total)
+		if r.FormValue("debug") == "true" {
+			if result.Debug, err = searchDebug(params); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			result.Debug.TookMillis = result.Meta.TookMillis
+			if !params.Scored() && !result.Degraded {
+				// Run it again with scoring, to show what skipping it saves.
+				scoredParams := params
+				scoredParams.Score = true
+				scored, err := store.Search(r.Context(), scoredParams)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				result.Debug.ScoredTookMillis = scored.Meta.TookMillis
+			}
+		}
+		writeJSON(w, r, http.StatusOK, result)
+	}
+}
+
+// explainResult is the /api/search/explain response body.
+type explainResult struct {
+	ID          string                 `json:"id"`
+	Matched     bool                   `json:"matched"`
+	Query       interface{}            `json:"query"`
+	Explanation map[string]interface{} `json:"explanation"`
+}
+
+// explainHandler shows how an item scores against a search, term by term,
+// for tuning relevance. Items that don't match get a 404, with the
+// explanation of why not. Explaining is expensive, so it needs
+// ALLOW_EXPLAIN=true.
+func explainHandler(cfg Config, client *elastic.Client, store *esStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !cfg.AllowExplain {
+			http.Error(w, "explain is disabled, set ALLOW_EXPLAIN=true to enable it", http.StatusForbidden)
+			return
+		}
+		id := r.FormValue("id")
+		if id == "" {
+			http.Error(w, "id is required", http.StatusBadRequest)
+			return
+		}
+		params, err := parseSearchParams(cfg, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		query := search.BuildQuery(params)
+		var res *elastic.ExplainResponse
+		routing, err := store.routingFor(r.Context(), id)
+		if err == nil {
+			explain := client.Explain(cfg.IndexName, "item", id).Query(query)
+			if routing != "" {
+				explain = explain.Routing(routing)
+			}
+			res, err = explain.Do(r.Context())
+		}
+		if elastic.IsNotFound(err) {
+			http.Error(w, "item "+id+" not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		result := explainResult{ID: id, Matched: res.Matched, Explanation: res.Explanation}
+		if result.Query, err = query.Source(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !result.Matched {
+			writeJSON(w, r, http.StatusNotFound, result)
+			return
+		}
+		writeJSON(w, r, http.StatusOK, result)
+	}
+}
+
+// parseSearchParams reads the search params from the request's form values.
+// The mode's defaults apply to the params that aren't given, and the page
+// size is capped at the configured maximum.
+func parseSearchParams(cfg Config, r *http.Request) (search.Params, error) {
+	mode, err := search.ParseMode(r.FormValue("mode"), cfg.SearchMode)
+	if err != nil {
+		return search.Params{}, err
+	}
+	params := mode.Defaults(search.Params{
+		Name:               r.FormValue("name"),
+		ExcludeName:        r.FormValue("excludeName"),
+		Query:              r.FormValue("q"),
+		Wildcard:           r.FormValue("wildcard"),
+		Refine:             nonEmpty(r.Form["refine"]),
+		Boosts:             cfg.SearchBoosts,
+		Fuzziness:          cfg.SearchDefaults.Fuzziness,
+		MinimumShouldMatch: cfg.SearchDefaults.MinimumShouldMatch,
+		RecencyDecay:       cfg.SearchDefaults.Recency,
+		Size:               cfg.DefaultPageSize,
+	})
+	params.IncludeArchived = boolParam(r, "includeArchived", params.IncludeArchived)
+	params.InStock = boolParam(r, "inStock", params.InStock)
+	params.Recency = boolParam(r, "recency", params.Recency)
+	params.SearchNotes = r.FormValue("searchNotes") == "true"
+	params.Operators = r.FormValue("operators") == "true"
+	params.Collapse = r.FormValue("collapse") == "true"
+	params.Score = r.FormValue("score") == "true"
+	if params.Lang, err = search.ParseLang(r.FormValue("lang")); err != nil {
+		return params, err
+	}
+	for _, v := range nonEmpty(r.Form["require"]) {
+		c, err := search.ParseClause(v)
+		if err != nil {
+			return params, err
+		}
+		params.Require = append(params.Require, c)
+	}
+	for _, v := range nonEmpty(r.Form["prefer"]) {
+		c, err := search.ParseClause(v)
+		if err != nil {
+			return params, err
+		}
+		params.Prefer = append(params.Prefer, c)
+	}
+	if brands := r.FormValue("brand"); brands != "" {
+		params.Brands = nonEmpty(strings.Split(brands, ","))
+	}
+	if tags := r.FormValue("tags"); tags != "" {
+		params.Tags = normalizeTags(strings.Split(tags, ","))
+	}
+	if tags := r.FormValue("excludeTags"); tags != "" {
+		params.ExcludeTags = normalizeTags(strings.Split(tags, ","))
+	}
+	if from, err := strconv.Atoi(r.FormValue("from")); err == nil && from > 0 {
+		params.From = from
+	}
+	if size, err := strconv.Atoi(r.FormValue("size")); err == nil && size > 0 {
+		params.Size = size
+	}
+	if params.Size > cfg.MaxPageSize {
+		params.Size = cfg.MaxPageSize
+	}
+	return params, params.Validate()
+}
+
+// boolParam reads a true/false form value, def if it isn't given.
+func boolParam(r *http.Request, name string, def bool) bool {
+	v := r.FormValue(name)
+	if v == "" {
+		return def
+	}
+	return v == "true"
+}
+
+// searchIndices returns the indices a search should run against.
+func searchIndices(cfg Config, params search.Params) []string {
+	if params.IncludeArchived {
+		return []string{cfg.IndexName, cfg.ArchivedIndexName}
+	}
+	return []string{cfg.IndexName}
+}
+
+// nonEmpty drops empty values.
+func nonEmpty(values []string) []string {
+	var out []string
+	for _, v := range values {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// newListPage builds the search results view. Each refinement becomes a
+// breadcrumb linking to the same search without it, and each brand a link
+// narrowing the search to it.
+func newListPage(r *http.Request, params search.Params, result schema.SearchResponse) schema.ListPage {
+	query := url.Values{}
+	for key, values := range r.Form {
+		if key != "from" {
+			query[key] = values
+		}
+	}
+
+	page := schema.ListPage{
+		Items:      result.Item,
+		Query:      query,
+		Warning:    result.Warning,
+		Variants:   result.Variants,
+		Pagination: newPagination(result.Total, params.From, params.Size),
+	}
+	if params.Collapse {
+		// Page through the groups, not the items in them.
+		page.Pagination = newPagination(result.Groups, params.From, params.Size)
+	}
+	for _, b := range result.Brands {
+		narrowed := url.Values{}
+		for key, values := range query {
+			narrowed[key] = values
+		}
+		narrowed.Set("brand", b.Brand)
+		page.Brands = append(page.Brands, schema.BrandFacet{
+			Brand: b.Brand,
+			Count: b.Count,
+			URL:   "/search/?" + narrowed.Encode(),
+		})
+	}
+	for i, refine := range params.Refine {
+		without := url.Values{}
+		for key, values := range query {
+			without[key] = values
+		}
+		without["refine"] = append(append([]string{}, params.Refine[:i]...), params.Refine[i+1:]...)
+		page.Refinements = append(page.Refinements, schema.Breadcrumb{
+			Label:     refine,
+			RemoveURL: "/search/?" + without.Encode(),
+		})
+	}
+	return page
+}
+
+const (
+	// maxPageLinks caps how many numbered page links are shown.
+	maxPageLinks = 9
+	// maxResultWindow is how deep Elasticsearch lets a search page by
+	// default (index.max_result_window).
+	maxResultWindow = 10000
+)
+
+// newPagination works out the pages for total hits shown size at a time,
+// starting at from. Pages past the result window aren't offered since
+// Elasticsearch would refuse them.
+func newPagination(total int64, from, size int) schema.Pagination {
+	p := schema.Pagination{Size: size}
+	if total <= 0 || size <= 0 {
+		return p
+	}
+	if total > maxResultWindow {
+		total = maxResultWindow
+	}
+	p.TotalPages = int((total + int64(size) - 1) / int64(size))
+	p.CurrentPage = from/size + 1
+	if p.CurrentPage > p.TotalPages {
+		p.CurrentPage = p.TotalPages
+	}
+	p.HasPrev = p.CurrentPage > 1
+	p.HasNext = p.CurrentPage < p.TotalPages
+	if p.TotalPages == 1 {
+		return p
+	}
+
+	// Center the window on the current page, sliding it back in at
+	// either end.
+	first := p.CurrentPage - maxPageLinks/2
+	if last := first + maxPageLinks - 1; last > p.TotalPages {
+		first -= last - p.TotalPages
+	}
+	if first < 1 {
+		first = 1
+	}
+	for n := first; n <= p.TotalPages && len(p.PageNumbers) < maxPageLinks; n++ {
+		p.PageNumbers = append(p.PageNumbers, n)
+	}
+	return p
+}
+
+// searchDebug describes the query sent to Elasticsearch for params.
+func searchDebug(params search.Params) (*schema.SearchDebug, error) {
+	source, err := search.BuildQuery(params).Source()
+	if err != nil {
+		return nil, err
+	}
+	debug := &schema.SearchDebug{Query: source, Scored: params.Scored()}
+	for _, b := range params.EffectiveBoosts() {
+		debug.Boosts = append(debug.Boosts, b.String())
+	}
+	for _, c := range params.Require {
+		debug.Require = append(debug.Require, c.String())
+	}
+	for _, c := range params.Prefer {
+		debug.Prefer = append(debug.Prefer, c.String())
+	}
+	return debug, nil
+}
+
+// stockCounts is how many items match a search, and how many of those are
+// in stock.
+type stockCounts struct {
+	Total   int64 `json:"total"`
+	InStock int64 `json:"in_stock"`
+}
+
+// stockCountsHandler counts the items matching a search without fetching
+// them, for "X available" badges.
+func stockCountsHandler(cfg Config, client *elastic.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		params, err := parseSearchParams(cfg, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		inStock := elastic.NewFilterAggregation().Filter(elastic.NewRangeQuery("stock").Gt(0))
+		query := search.BuildQuery(params)
+		start := time.Now()
+		searchResult, err := client.Search().
+			Index(searchIndices(cfg, params)...).
+			IgnoreUnavailable(true).
+			Query(query).
+			Aggregation("in_stock", inStock).
+			Size(0).
+			Do(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		logSlowSearch(r.Context(), cfg, params, query, time.Since(start), searchResult.TookInMillis)
+
+		counts := stockCounts{Total: searchResult.Hits.TotalHits}
+		if agg, found := searchResult.Aggregations.Filter("in_stock"); found {
+			counts.InStock = agg.DocCount
+		}
+		writeJSON(w, r, http.StatusOK, counts)
+	}
+}
@@ -0,0 +1,43 @@
+package search
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// FieldBoost weights matches on a field in free-text search.
+type FieldBoost struct {
+	Field string  `json:"field"`
+	Boost float64 `json:"boost"`
+}
+
+// String formats the boost the way Elasticsearch does, as field^boost.
+func (b FieldBoost) String() string {
+	return b.Field + "^" + strconv.FormatFloat(b.Boost, 'g', -1, 64)
+}
+
+// ParseBoosts parses a comma-separated list such as
+// "name^3,description^1,tags^2". A field without a boost gets 1.
+func ParseBoosts(s string) ([]FieldBoost, error) {
+	var boosts []FieldBoost
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		field, weight := part, "1"
+		if i := strings.Index(part, "^"); i >= 0 {
+			field, weight = part[:i], part[i+1:]
+		}
+		boost, err := strconv.ParseFloat(weight, 64)
+		if field == "" || err != nil || boost <= 0 {
+			return nil, fmt.Errorf("invalid field boost %q, want field^weight with a positive weight", part)
+		}
+		boosts = append(boosts, FieldBoost{Field: field, Boost: boost})
+	}
+	if len(boosts) == 0 {
+		return nil, fmt.Errorf("no field boosts in %q", s)
+	}
+	return boosts, nil
+}
@@ -0,0 +1,54 @@
+package search
+
+import (
+	"fmt"
+	"gopkg.in/olivere/elastic.v6"
+	"strconv"
+	"strings"
+)
+
+// Clause matches a field against a value.
+type Clause struct {
+	Field string
+	Value string
+	// Boost weights optional clauses, 1 if zero. It's ignored for
+	// required ones, which don't score.
+	Boost float64
+}
+
+// String formats the clause as field:value^boost.
+func (c Clause) String() string {
+	s := c.Field + ":" + c.Value
+	if c.Boost != 0 {
+		s += "^" + strconv.FormatFloat(c.Boost, 'g', -1, 64)
+	}
+	return s
+}
+
+// ParseClause parses field:value, optionally followed by ^boost as in
+// "name:desk^2".
+func ParseClause(s string) (Clause, error) {
+	i := strings.Index(s, ":")
+	if i <= 0 || i == len(s)-1 {
+		return Clause{}, fmt.Errorf("invalid clause %q, want field:value", s)
+	}
+	c := Clause{Field: s[:i], Value: s[i+1:]}
+	if j := strings.LastIndex(c.Value, "^"); j >= 0 {
+		boost, err := strconv.ParseFloat(c.Value[j+1:], 64)
+		if err != nil || boost <= 0 || j == 0 {
+			return Clause{}, fmt.Errorf("invalid clause %q, want field:value^weight with a positive weight", s)
+		}
+		c.Value, c.Boost = c.Value[:j], boost
+	}
+	return c, nil
+}
+
+// query matches the clause's value against its field, analyzed the way the
+// field is.
+func (c Clause) query() *elastic.MatchQuery {
+	query := elastic.NewMatchQuery(c.Field, c.Value)
+	if c.Boost != 0 {
+		query = query.Boost(c.Boost)
+	}
+	return query
+}
@@ -0,0 +1,111 @@
+package search
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// builtinDefaults is the defaults file compiled into the binary.
+//
+//go:embed defaults.json
+var builtinDefaults []byte
+
+// Defaults are the relevance settings searches start from. They're read
+// from a JSON file so they can be tuned without recompiling.
+type Defaults struct {
+	// Size is the page size used when a request doesn't ask for one.
+	Size int `json:"size"`
+	// Boosts are the fields free text is matched against and their
+	// weights.
+	Boosts []FieldBoost `json:"boosts"`
+	// Fuzziness is the edit distance free text words may be off by, such
+	// as "AUTO" or "1". Empty means words must match exactly.
+	Fuzziness string `json:"fuzziness"`
+	// MinimumShouldMatch is how many free text words an item must match,
+	// such as "2" or "75%". Empty means any one of them.
+	MinimumShouldMatch string `json:"minimum_should_match"`
+	// Recency shapes the boost recently created items get.
+	Recency Decay `json:"recency"`
+}
+
+// Decay is a gauss decay on the creation date: items created Scale ago
+// get Decay times the boost of an item created now.
+type Decay struct {
+	Scale string  `json:"scale"`
+	Decay float64 `json:"decay"`
+}
+
+// Builtin are the defaults compiled into the binary.
+var Builtin = mustParseDefaults(builtinDefaults)
+
+var (
+	// DefaultSize is the builtin page size.
+	DefaultSize = Builtin.Size
+	// DefaultBoosts are the builtin field boosts.
+	DefaultBoosts = Builtin.Boosts
+)
+
+var (
+	fuzzinessPattern   = regexp.MustCompile(`^(AUTO(:\d+,\d+)?|[0-2])$`)
+	shouldMatchPattern = regexp.MustCompile(`^(\d+<)?-?\d+%?$`)
+	decayScalePattern  = regexp.MustCompile(`^\d+(\.\d+)?(ms|s|m|h|d)$`)
+)
+
+// ParseDefaults decodes and validates a defaults file. Unknown fields are
+// refused, so typos don't go unnoticed.
+func ParseDefaults(data []byte) (Defaults, error) {
+	var d Defaults
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&d); err != nil {
+		return d, fmt.Errorf("invalid search defaults: %v", err)
+	}
+	return d, d.Validate()
+}
+
+func mustParseDefaults(data []byte) Defaults {
+	d, err := ParseDefaults(data)
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
+
+// Validate reports every invalid setting, not just the first.
+func (d Defaults) Validate() error {
+	var problems []string
+	if d.Size <= 0 {
+		problems = append(problems, fmt.Sprintf("size must be positive, got %d", d.Size))
+	}
+	if len(d.Boosts) == 0 {
+		problems = append(problems, "boosts must not be empty")
+	}
+	for _, b := range d.Boosts {
+		if b.Field == "" || b.Boost <= 0 {
+			problems = append(problems, fmt.Sprintf("boost %s needs a field and a positive weight", b))
+		}
+	}
+	if d.Fuzziness != "" && !fuzzinessPattern.MatchString(d.Fuzziness) {
+		problems = append(problems, fmt.Sprintf("fuzziness must be AUTO, AUTO:low,high, 0, 1 or 2, got %q", d.Fuzziness))
+	}
+	for _, part := range strings.Fields(d.MinimumShouldMatch) {
+		if !shouldMatchPattern.MatchString(part) {
+			problems = append(problems, fmt.Sprintf("minimum_should_match must be a count or percentage such as 2 or 75%%, got %q", d.MinimumShouldMatch))
+			break
+		}
+	}
+	if !decayScalePattern.MatchString(d.Recency.Scale) {
+		problems = append(problems, fmt.Sprintf("recency.scale must be a duration such as 30d, got %q", d.Recency.Scale))
+	}
+	if d.Recency.Decay <= 0 || d.Recency.Decay >= 1 {
+		problems = append(problems, fmt.Sprintf("recency.decay must be between 0 and 1, got %g", d.Recency.Decay))
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid search defaults:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
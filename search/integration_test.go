@@ -0,0 +1,250 @@
+//go:build integration
+
+package search
+
+// The tests and benchmarks in this file run against a throwaway
+// Elasticsearch container. They need a running Docker daemon and are
+// skipped without one. Run them with:
+//
+//	go test -tags integration ./search
+//	go test -tags integration ./search -run '^$' -bench SearchES -benchtime 2s
+
+import (
+	"context"
+	"fmt"
+	"gopkg.in/olivere/elastic.v6"
+	"invento-search/schema"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/wait"
+)
+
+const esImage = "docker.elastic.co/elasticsearch/elasticsearch:6.8.23"
+
+// benchItems is how many generated items BenchmarkSearchES searches.
+const benchItems = 5000
+
+var (
+	esOnce      sync.Once
+	esContainer testcontainers.Container
+	esClient    *elastic.Client
+	esErr       error
+)
+
+func TestMain(m *testing.M) {
+	code := m.Run()
+	if esContainer != nil {
+		esContainer.Terminate(context.Background())
+	}
+	os.Exit(code)
+}
+
+// testES returns a client for a single-node cluster shared by the tests,
+// starting it on first use. It skips tb if the cluster can't be started.
+func testES(tb testing.TB) *elastic.Client {
+	tb.Helper()
+	esOnce.Do(func() {
+		ctx := context.Background()
+		esContainer, esErr = testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
+			ContainerRequest: testcontainers.ContainerRequest{
+				Image:        esImage,
+				ExposedPorts: []string{"9200/tcp"},
+				Env: map[string]string{
+					"discovery.type": "single-node",
+					"ES_JAVA_OPTS":   "-Xms512m -Xmx512m",
+				},
+				WaitingFor: wait.ForHTTP("/").WithPort("9200/tcp").WithStartupTimeout(2 * time.Minute),
+			},
+			Started: true,
+		})
+		if esErr != nil {
+			return
+		}
+		var endpoint string
+		if endpoint, esErr = esContainer.Endpoint(ctx, "http"); esErr != nil {
+			return
+		}
+		esClient, esErr = elastic.NewClient(elastic.SetURL(endpoint), elastic.SetSniff(false))
+	})
+	if esErr != nil {
+		tb.Skipf("no Elasticsearch container: %v", esErr)
+	}
+	return esClient
+}
+
+// newTestIndex creates an index with the current mapping holding items,
+// each stored under its SKU, and deletes it when tb is done.
+func newTestIndex(tb testing.TB, client *elastic.Client, index string, items []schema.Item) {
+	tb.Helper()
+	ctx := context.Background()
+	if _, err := client.CreateIndex(index).BodyString(schema.Mapping).Do(ctx); err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { client.DeleteIndex(index).Do(context.Background()) })
+
+	bulk := client.Bulk().Index(index).Type("item")
+	for i, item := range items {
+		if item.Created.IsZero() {
+			item.Created = time.Now().Add(-time.Duration(i) * time.Hour)
+		}
+		bulk.Add(elastic.NewBulkIndexRequest().Id(item.SKU).Doc(item))
+		if bulk.NumberOfActions() == 500 || i == len(items)-1 {
+			res, err := bulk.Do(ctx)
+			if err != nil {
+				tb.Fatal(err)
+			}
+			if res.Errors {
+				tb.Fatalf("indexing failed for %d items", len(res.Failed()))
+			}
+		}
+	}
+	if _, err := client.Refresh(index).Do(ctx); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+// searchIDs runs the search p describes against index and returns the ids
+// of the hits, best first.
+func searchIDs(tb testing.TB, client *elastic.Client, index string, p Params) []string {
+	tb.Helper()
+	res, err := client.Search().Index(index).Query(BuildQuery(p)).From(p.From).Size(p.Size).Do(context.Background())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	var ids []string
+	for _, hit := range res.Hits.Hits {
+		ids = append(ids, hit.Id)
+	}
+	return ids
+}
+
+// generatedItems returns count items made up from a few names, brands
+// and tags.
+func generatedItems(count int) []schema.Item {
+	names := []string{"monitor", "desk", "laptop", "mouse", "chair", "mug", "notebook", "shirt"}
+	adjectives := []string{"Black", "White", "Green", "Wooden", "Plain", "Samsung", "Dell", "LG"}
+	tags := [][]string{{"electronics"}, {"furniture", "office"}, {"office", "electronics"}, {"merch"}, {"electronics", "refurbished"}}
+	items := make([]schema.Item, count)
+	for i := range items {
+		name := names[i%len(names)]
+		items[i] = schema.Item{
+			Name:        name,
+			SKU:         fmt.Sprintf("GEN-%05d", i),
+			Description: fmt.Sprintf("%s %s complete with cable, batch %d.", adjectives[i%len(adjectives)], name, i),
+			Stock:       i % 50,
+			Tags:        tags[i%len(tags)],
+		}
+	}
+	return items
+}
+
+// BenchmarkSearchES measures searching an index of benchItems generated
+// items for each of benchCases, building the query included.
+func BenchmarkSearchES(b *testing.B) {
+	client := testES(b)
+	newTestIndex(b, client, "items-bench", generatedItems(benchItems))
+	for _, c := range benchCases {
+		b.Run(c.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				_, err := client.Search().
+					Index("items-bench").
+					Query(BuildQuery(c.params)).
+					From(c.params.From).Size(c.params.Size).
+					Do(context.Background())
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestPreferOnlyES(t *testing.T) {
+	client := testES(t)
+	newTestIndex(t, client, "items-prefer", []schema.Item{
+		{SKU: "DSK-1", Name: "desk", Tags: []string{"furniture"}},
+		{SKU: "DSK-2", Name: "desk", Tags: []string{"office"}},
+	})
+	ids := searchIDs(t, client, "items-prefer", Params{Prefer: []Clause{{Field: "tags", Value: "office", Boost: 2}}, Size: 10})
+	if len(ids) != 2 || ids[0] != "DSK-2" {
+		t.Errorf("preferring office found %v, want both with DSK-2 first", ids)
+	}
+}
+
+func TestBoostsRankingES(t *testing.T) {
+	client := testES(t)
+	newTestIndex(t, client, "items-boosts", []schema.Item{
+		{SKU: "LMP-1", Name: "lamp", Description: "A lamp for the desk."},
+		{SKU: "DSK-1", Name: "desk", Description: "Plain and sturdy."},
+	})
+	// The builtin boosts weight the name three times the description.
+	ids := searchIDs(t, client, "items-boosts", Params{Query: "desk", Size: 10})
+	if len(ids) != 2 || ids[0] != "DSK-1" {
+		t.Errorf("searching desk found %v, want the name match DSK-1 first", ids)
+	}
+	// Weighting the description higher turns that round.
+	boosts := []FieldBoost{{Field: "name", Boost: 1}, {Field: "description", Boost: 10}}
+	ids = searchIDs(t, client, "items-boosts", Params{Query: "desk", Boosts: boosts, Size: 10})
+	if len(ids) != 2 || ids[0] != "LMP-1" {
+		t.Errorf("searching desk with %v found %v, want the description match LMP-1 first", boosts, ids)
+	}
+}
+
+// analyze returns the tokens field of index turns text into.
+func analyze(t *testing.T, client *elastic.Client, index, field, text string) []string {
+	t.Helper()
+	res, err := client.IndexAnalyze().Index(index).Field(field).Text(text).Do(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tokens []string
+	for _, token := range res.Tokens {
+		tokens = append(tokens, token.Token)
+	}
+	return tokens
+}
+
+func TestSearchNotesES(t *testing.T) {
+	client := testES(t)
+	newTestIndex(t, client, "items-notes", []schema.Item{
+		{SKU: "SHO-1", Name: "shoes", Notes: "Supplier says these run small."},
+		{SKU: "SHO-2", Name: "boots"},
+	})
+	// Notes are english-analyzed, so words are stemmed.
+	if tokens := analyze(t, client, "items-notes", "notes", "running"); len(tokens) != 1 || tokens[0] != "run" {
+		t.Errorf("notes analyze running as %v, want [run]", tokens)
+	}
+	if ids := searchIDs(t, client, "items-notes", Params{Query: "running", SearchNotes: true, Size: 10}); len(ids) != 1 || ids[0] != "SHO-1" {
+		t.Errorf("searching notes for running found %v, want SHO-1", ids)
+	}
+	// Without SearchNotes they aren't searched.
+	if ids := searchIDs(t, client, "items-notes", Params{Query: "running", Size: 10}); len(ids) != 0 {
+		t.Errorf("searching running without notes found %v", ids)
+	}
+}
+
+func TestLangIndonesianES(t *testing.T) {
+	client := testES(t)
+	newTestIndex(t, client, "items-lang", []schema.Item{
+		{SKU: "MJA-1", Name: "meja", Description: "Meja kayu untuk membaca."},
+		{SKU: "KRS-1", Name: "kursi", Description: "Kursi plastik."},
+	})
+	// description.id strips Indonesian affixes, description leaves them.
+	if tokens := analyze(t, client, "items-lang", "description.id", "membaca"); len(tokens) != 1 || tokens[0] != "baca" {
+		t.Errorf("description.id analyzes membaca as %v, want [baca]", tokens)
+	}
+	if tokens := analyze(t, client, "items-lang", "description", "membaca"); len(tokens) != 1 || tokens[0] != "membaca" {
+		t.Errorf("description analyzes membaca as %v, want it unstemmed", tokens)
+	}
+	if ids := searchIDs(t, client, "items-lang", Params{Query: "baca", Lang: LangIndonesian, Size: 10}); len(ids) != 1 || ids[0] != "MJA-1" {
+		t.Errorf("searching baca in Indonesian found %v, want MJA-1", ids)
+	}
+	if ids := searchIDs(t, client, "items-lang", Params{Query: "baca", Size: 10}); len(ids) != 0 {
+		t.Errorf("searching baca without lang found %v", ids)
+	}
+}
@@ -0,0 +1,37 @@
+package search
+
+import "fmt"
+
+// Lang selects the language analysis descriptions are searched with.
+type Lang string
+
+const (
+	// LangDefault searches descriptions as analyzed by the standard
+	// analyzer, which splits words but doesn't stem them.
+	LangDefault Lang = ""
+	// LangEnglish searches the english-analyzed description.en.
+	LangEnglish Lang = "en"
+	// LangIndonesian searches the indonesian-analyzed description.id.
+	LangIndonesian Lang = "id"
+)
+
+// langFields are the fields with a sub-field per language.
+var langFields = map[string]bool{"description": true}
+
+// ParseLang parses a language code, an empty one being LangDefault.
+func ParseLang(s string) (Lang, error) {
+	switch Lang(s) {
+	case LangDefault, LangEnglish, LangIndonesian:
+		return Lang(s), nil
+	}
+	return "", fmt.Errorf("unknown language %q, want %s or %s", s, LangEnglish, LangIndonesian)
+}
+
+// field returns the sub-field of field analyzed for the language, or field
+// itself if it has none.
+func (l Lang) field(field string) string {
+	if l == LangDefault || !langFields[field] {
+		return field
+	}
+	return field + "." + string(l)
+}
@@ -0,0 +1,48 @@
+package search
+
+import (
+	"invento-search/schema"
+	"testing"
+)
+
+func TestLang(t *testing.T) {
+	assertQuery(t, Params{Query: "meja", Lang: LangIndonesian},
+		[]string{`"fields":["name^3.000000","description.id^1.000000","tags^2.000000"]`}, nil)
+	assertQuery(t, Params{Query: "running shoes", Lang: LangEnglish},
+		[]string{`"fields":["name^3.000000","description.en^1.000000","tags^2.000000"]`}, nil)
+	// Operator searches and refinements use the sub-fields as well.
+	assertQuery(t, Params{Query: "shoes -kids", Refine: []string{"leather"}, Lang: LangEnglish},
+		[]string{`"simple_query_string":{"default_operator":"and","fields":["name^3.000000","description.en^1.000000","tags^2.000000"]`,
+			`"multi_match":{"fields":["name^3.000000","description.en^1.000000","tags^2.000000"],"query":"leather"}`}, nil)
+	assertQuery(t, Params{Query: "shoes"}, nil, []string{"description.en", "description.id"})
+}
+
+func TestParseLang(t *testing.T) {
+	for s, want := range map[string]Lang{"": LangDefault, "en": LangEnglish, "id": LangIndonesian} {
+		if lang, err := ParseLang(s); err != nil || lang != want {
+			t.Errorf("ParseLang(%q) = %q, %v", s, lang, err)
+		}
+	}
+	for _, s := range []string{"fr", "EN", "english"} {
+		if _, err := ParseLang(s); err == nil {
+			t.Errorf("ParseLang(%q) succeeded", s)
+		}
+	}
+}
+
+// TestLangFieldsMapped checks that the mapping has the sub-field every
+// language searches, so a search with lang never hits an unmapped field.
+func TestLangFieldsMapped(t *testing.T) {
+	properties, err := schema.Properties()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for field := range langFields {
+		subFields, _ := properties[field]["fields"].(map[string]interface{})
+		for _, lang := range []Lang{LangEnglish, LangIndonesian} {
+			if _, ok := subFields[string(lang)]; !ok {
+				t.Errorf("mapping has no %s sub-field", lang.field(field))
+			}
+		}
+	}
+}
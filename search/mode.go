@@ -0,0 +1,41 @@
+package search
+
+import "fmt"
+
+// Mode bundles the search defaults for who is searching. Each default can
+// still be overridden by its own param.
+type Mode string
+
+const (
+	// ModeDefault leaves archived items out, and neither filters by stock
+	// nor favours recent items, as searches did before there were modes.
+	ModeDefault Mode = ""
+	// ModeAdmin shows everything, archived and out of stock items
+	// included, ranked by relevance alone.
+	ModeAdmin Mode = "admin"
+	// ModeStorefront hides archived and out of stock items and favours
+	// recently added ones.
+	ModeStorefront Mode = "storefront"
+)
+
+// ParseMode parses a mode name, returning def when s is empty. "default"
+// names ModeDefault.
+func ParseMode(s string, def Mode) (Mode, error) {
+	switch Mode(s) {
+	case "":
+		return def, nil
+	case "default":
+		return ModeDefault, nil
+	case ModeAdmin, ModeStorefront:
+		return Mode(s), nil
+	}
+	return "", fmt.Errorf("unknown search mode %q, want default, %s or %s", s, ModeAdmin, ModeStorefront)
+}
+
+// Defaults returns params with the mode's defaults applied.
+func (m Mode) Defaults(p Params) Params {
+	p.IncludeArchived = m == ModeAdmin
+	p.InStock = m == ModeStorefront
+	p.Recency = m == ModeStorefront
+	return p
+}
@@ -0,0 +1,28 @@
+package search
+
+import "testing"
+
+func TestModeDefaults(t *testing.T) {
+	for _, tt := range []struct {
+		mode                              Mode
+		includeArchived, inStock, recency bool
+	}{
+		{ModeDefault, false, false, false},
+		{ModeAdmin, true, false, false},
+		{ModeStorefront, false, true, true},
+	} {
+		p := tt.mode.Defaults(Params{IncludeArchived: true, InStock: true, Recency: true})
+		if p.IncludeArchived != tt.includeArchived || p.InStock != tt.inStock || p.Recency != tt.recency {
+			t.Errorf("mode %q sets includeArchived %v, inStock %v and recency %v", tt.mode, p.IncludeArchived, p.InStock, p.Recency)
+		}
+	}
+
+	for s, want := range map[string]Mode{"": ModeStorefront, "default": ModeDefault, "admin": ModeAdmin} {
+		if mode, err := ParseMode(s, ModeStorefront); err != nil || mode != want {
+			t.Errorf("ParseMode(%q) = %q, %v, want %q", s, mode, err, want)
+		}
+	}
+	if _, err := ParseMode("shop", ModeDefault); err == nil {
+		t.Error("ParseMode(\"shop\") succeeded")
+	}
+}
@@ -0,0 +1,290 @@
+package search
+
+import (
+	"errors"
+	"gopkg.in/olivere/elastic.v6"
+	"strings"
+)
+
+// Params holds everything a search request can ask for.
+type Params struct {
+	// Name matches the item name exactly.
+	Name string
+	// ExcludeName drops items with exactly this name.
+	ExcludeName string
+	// Query is free text matched against the fields in Boosts.
+	Query string
+	// Refine narrows the results further, each refinement is ANDed with the
+	// rest of the query.
+	Refine []string
+	// Wildcard matches name or SKU against a pattern such as "LG-*".
+	Wildcard string
+	// Require are clauses items must match. They filter without
+	// affecting the score.
+	Require []Clause
+	// Prefer are clauses items needn't match, but rank higher for, by each
+	// clause's boost.
+	Prefer []Clause
+	// Brands restricts results to items of any of the given brands.
+	Brands []string
+	// Tags restricts results to items carrying all of the given tags.
+	Tags []string
+	// ExcludeTags drops items carrying any of the given tags.
+	ExcludeTags []string
+	// Boosts are the fields free text is matched against and their
+	// weights, DefaultBoosts if empty.
+	Boosts []FieldBoost
+	// Fuzziness and MinimumShouldMatch tune free text matching, see
+	// Defaults.
+	Fuzziness          string
+	MinimumShouldMatch string
+	// SearchNotes also matches free text against the staff notes.
+	SearchNotes bool
+	// Lang selects the language analysis free text is matched with.
+	Lang Lang
+	// Operators parses Query with the simple_query_string syntax even when
+	// it doesn't look like it uses any operators.
+	Operators bool
+	// IncludeArchived also searches the archived items index.
+	IncludeArchived bool
+	// InStock drops items that are out of stock.
+	InStock bool
+	// Recency favours recently created items on top of relevance.
+	Recency bool
+	// RecencyDecay shapes the Recency boost, Builtin.Recency if zero.
+	RecencyDecay Decay
+	// Collapse returns only the top item per name.
+	Collapse bool
+	// Score forces scoring hits, which filter-only searches otherwise
+	// skip, see Scored.
+	Score bool
+	From  int
+	Size  int
+}
+
+// ErrLeadingWildcard is returned for wildcard patterns that start with a
+// wildcard, which force Elasticsearch to scan every term in the index.
+var ErrLeadingWildcard = errors.New("wildcard patterns must not start with * or ?")
+
+// Validate reports whether the params can be turned into a query.
+func (p Params) Validate() error {
+	if strings.HasPrefix(p.Wildcard, "*") || strings.HasPrefix(p.Wildcard, "?") {
+		return ErrLeadingWildcard
+	}
+	return nil
+}
+
+// HasQuery reports whether any search criteria were given.
+func (p Params) HasQuery() bool {
+	return p.Name != "" || p.ExcludeName != "" || p.Query != "" || p.Wildcard != "" || len(p.Require) > 0 || len(p.Prefer) > 0
+}
+
+// Filtered reports whether the params narrow the results down at all, as
+// opposed to matching every item.
+func (p Params) Filtered() bool {
+	return p.HasQuery() || len(p.Refine) > 0 || len(p.Brands) > 0 || len(p.Tags) > 0 || len(p.ExcludeTags) > 0 || p.InStock
+}
+
+// Scored reports whether hits are scored. Only free text, prefer clauses
+// and recency affect the ranking, without them every hit would score the
+// same and scoring is skipped, unless Score is set.
+func (p Params) Scored() bool {
+	return p.Score || p.Query != "" || len(p.Refine) > 0 || len(p.Prefer) > 0 || p.Recency
+}
+
+// Fallback returns simpler params to retry with when the search p
+// describes fails: the name and free text, matched against the name alone,
+// with the same paging and archive and stock filters. Without either,
+// every item matches.
+func (p Params) Fallback() Params {
+	return Params{
+		Name:            p.Name,
+		Query:           p.Query,
+		Boosts:          []FieldBoost{{Field: "name", Boost: 1}},
+		IncludeArchived: p.IncludeArchived,
+		InStock:         p.InStock,
+		From:            p.From,
+		Size:            p.Size,
+	}
+}
+
+// EffectiveBoosts returns the field boosts free text is searched with.
+func (p Params) EffectiveBoosts() []FieldBoost {
+	if len(p.Boosts) == 0 {
+		return DefaultBoosts
+	}
+	return p.Boosts
+}
+
+// notesBoost weights notes matches when SearchNotes is set.
+var notesBoost = FieldBoost{Field: "notes", Boost: 1}
+
+// textFields are the fields free text is matched against, switched to
+// their sub-fields for Lang.
+func (p Params) textFields() []FieldBoost {
+	boosts := p.EffectiveBoosts()
+	if p.SearchNotes && !hasField(boosts, notesBoost.Field) {
+		boosts = append(append([]FieldBoost{}, boosts...), notesBoost)
+	}
+	if p.Lang == LangDefault {
+		return boosts
+	}
+	fields := make([]FieldBoost, len(boosts))
+	for i, b := range boosts {
+		fields[i] = FieldBoost{Field: p.Lang.field(b.Field), Boost: b.Boost}
+	}
+	return fields
+}
+
+func hasField(boosts []FieldBoost, field string) bool {
+	for _, b := range boosts {
+		if b.Field == field {
+			return true
+		}
+	}
+	return false
+}
+
+// BuildQuery turns search params into an Elasticsearch query.
+func BuildQuery(p Params) elastic.Query {
+	query := elastic.NewBoolQuery()
+	if p.Name != "" {
+		query = query.Must(elastic.NewTermQuery("name.raw", p.Name))
+	}
+	if p.Query != "" {
+		if p.Operators || HasOperators(p.Query) {
+			query = query.Must(operatorQuery(p.Query, p.textFields()))
+		} else {
+			query = query.Must(p.textQuery(p.Query))
+		}
+	}
+	for _, refine := range p.Refine {
+		query = query.Must(p.textQuery(refine))
+	}
+	if p.Wildcard != "" {
+		query = query.Must(elastic.NewBoolQuery().
+			Should(codeQuery("name.raw", p.Wildcard), codeQuery("sku", p.Wildcard)).
+			MinimumNumberShouldMatch(1))
+	}
+	for _, c := range p.Require {
+		query = query.Filter(c.query())
+	}
+	for _, c := range p.Prefer {
+		query = query.Should(c.query())
+	}
+	if len(p.Brands) > 0 {
+		query = query.Filter(elastic.NewTermsQuery("brand", stringsToInterfaces(p.Brands)...))
+	}
+	for _, tag := range p.Tags {
+		query = query.Filter(elastic.NewTermQuery("tags", tag))
+	}
+	if len(p.ExcludeTags) > 0 {
+		query = query.MustNot(elastic.NewTermsQuery("tags", stringsToInterfaces(p.ExcludeTags)...))
+	}
+	if p.ExcludeName != "" {
+		query = query.MustNot(elastic.NewTermQuery("name.raw", p.ExcludeName))
+	}
+	if p.InStock {
+		query = query.Filter(elastic.NewRangeQuery("stock").Gt(0))
+	}
+	if len(p.Prefer) > 0 && !p.required() {
+		// Without a must or filter clause one of the should clauses has to
+		// match, which would make Prefer filter.
+		query = query.Must(elastic.NewMatchAllQuery())
+	}
+	if p.Recency {
+		return recencyQuery(query, p.RecencyDecay)
+	}
+	if !p.Scored() {
+		// Runs every clause as a filter, which is cheaper and cacheable.
+		return elastic.NewConstantScoreQuery(query)
+	}
+	return query
+}
+
+// required reports whether BuildQuery adds any must or filter clauses.
+func (p Params) required() bool {
+	return p.Name != "" || p.Query != "" || len(p.Refine) > 0 || p.Wildcard != "" || len(p.Require) > 0 ||
+		len(p.Brands) > 0 || len(p.Tags) > 0 || p.InStock
+}
+
+// recencyQuery adds up to 1 to the score of query's hits depending on how
+// recently they were created, decaying as d says.
+func recencyQuery(query elastic.Query, d Decay) elastic.Query {
+	if d == (Decay{}) {
+		d = Builtin.Recency
+	}
+	decay := elastic.NewGaussDecayFunction().
+		FieldName("created").
+		Origin("now").
+		Scale(d.Scale).
+		Decay(d.Decay)
+	return elastic.NewFunctionScoreQuery().
+		Query(query).
+		AddScoreFunc(decay).
+		BoostMode("sum")
+}
+
+// textQuery matches free text against the boosted fields.
+func (p Params) textQuery(text string) elastic.Query {
+	query := elastic.NewMultiMatchQuery(text)
+	for _, b := range p.textFields() {
+		query = query.FieldWithBoost(b.Field, b.Boost)
+	}
+	if p.Fuzziness != "" {
+		query = query.Fuzziness(p.Fuzziness)
+	}
+	if p.MinimumShouldMatch != "" {
+		query = query.MinimumShouldMatch(p.MinimumShouldMatch)
+	}
+	return query
+}
+
+// operatorFlags are the simple_query_string operators searches may use.
+const operatorFlags = "AND|OR|NOT|PHRASE|PREFIX|PRECEDENCE|WHITESPACE|ESCAPE"
+
+// operatorQuery matches text using the simple_query_string syntax: "quoted
+// phrases", -negation, a | b, trailing * prefixes and parentheses. Terms are
+// ANDed so "monitor -dell" means monitor but not dell. Unlike query_string
+// it never fails on malformed input, so it's safe for user text.
+func operatorQuery(text string, boosts []FieldBoost) elastic.Query {
+	query := elastic.NewSimpleQueryStringQuery(text).
+		DefaultOperator("and").
+		Flags(operatorFlags)
+	for _, b := range boosts {
+		query = query.FieldWithBoost(b.Field, b.Boost)
+	}
+	return query
+}
+
+// HasOperators reports whether text looks like it uses the
+// simple_query_string syntax: a quote, a word starting with - or +, or a |.
+func HasOperators(text string) bool {
+	if strings.ContainsAny(text, "\"|") {
+		return true
+	}
+	for _, word := range strings.Fields(text) {
+		if len(word) > 1 && (word[0] == '-' || word[0] == '+') {
+			return true
+		}
+	}
+	return false
+}
+
+// codeQuery matches a keyword field against a wildcard pattern, using the
+// cheaper prefix query when the only wildcard is a trailing *.
+func codeQuery(field, pattern string) elastic.Query {
+	prefix := strings.TrimSuffix(pattern, "*")
+	if !strings.ContainsAny(prefix, "*?") {
+		return elastic.NewPrefixQuery(field, prefix)
+	}
+	return elastic.NewWildcardQuery(field, pattern)
+}
+
+func stringsToInterfaces(values []string) []interface{} {
+	out := make([]interface{}, len(values))
+	for i, v := range values {
+		out[i] = v
+	}
+	return out
+}
@@ -0,0 +1,34 @@
+package search
+
+import "testing"
+
+// benchCases are representative searches, from a lookup by name to free
+// text with filters, preferences and recency.
+var benchCases = []struct {
+	name   string
+	params Params
+}{
+	{"term", Params{Name: "monitor", Size: DefaultSize}},
+	{"multi-match", Params{Query: "black wooden", Size: DefaultSize}},
+	{"filtered", Params{Query: "monitor cable", Tags: []string{"electronics"}, ExcludeTags: []string{"refurbished"}, InStock: true, Size: DefaultSize}},
+	{"paginated", Params{Name: "monitor", From: 200, Size: 20}},
+	{"operators", Params{Query: `monitor -dell "complete with cable"`, Size: DefaultSize}},
+	{"preferred", Params{Query: "desk", Prefer: []Clause{{Field: "tags", Value: "office", Boost: 2}}, Recency: true, Lang: LangEnglish, Size: DefaultSize}},
+}
+
+// BenchmarkBuildQuery measures building the query for each of benchCases
+// and serializing it to JSON. That's only the work done before
+// Elasticsearch sees the request, see BenchmarkSearchES for the search
+// itself.
+func BenchmarkBuildQuery(b *testing.B) {
+	for _, c := range benchCases {
+		b.Run(c.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := BuildQuery(c.params).Source(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,150 @@
+package search
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// querySource returns the JSON BuildQuery makes of p.
+func querySource(t *testing.T, p Params) string {
+	t.Helper()
+	source, err := BuildQuery(p).Source()
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := json.Marshal(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(raw)
+}
+
+// assertQuery fails unless the query for p contains each of want and none
+// of notWant.
+func assertQuery(t *testing.T, p Params, want []string, notWant []string) {
+	t.Helper()
+	query := querySource(t, p)
+	for _, s := range want {
+		if !strings.Contains(query, s) {
+			t.Errorf("query lacks %s: %s", s, query)
+		}
+	}
+	for _, s := range notWant {
+		if strings.Contains(query, s) {
+			t.Errorf("query has %s: %s", s, query)
+		}
+	}
+}
+
+func TestBoosts(t *testing.T) {
+	assertQuery(t, Params{Query: "desk"},
+		[]string{`"multi_match":`, `"fields":["name^3.000000","description^1.000000","tags^2.000000"]`}, nil)
+	boosts := []FieldBoost{{Field: "name", Boost: 5}, {Field: "brand", Boost: 1.5}}
+	assertQuery(t, Params{Query: "desk", Boosts: boosts},
+		[]string{`"fields":["name^5.000000","brand^1.500000"]`}, []string{"description"})
+}
+
+func TestParseBoosts(t *testing.T) {
+	boosts, err := ParseBoosts(" name^3, tags ,brand^0.5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, b := range boosts {
+		got = append(got, b.String())
+	}
+	if strings.Join(got, ",") != "name^3,tags^1,brand^0.5" {
+		t.Errorf("parsed %v", got)
+	}
+	for _, s := range []string{"", ",", "name^", "name^-1", "name^0", "^2", "name^high"} {
+		if _, err := ParseBoosts(s); err == nil {
+			t.Errorf("ParseBoosts(%q) succeeded", s)
+		}
+	}
+}
+
+func TestSearchNotes(t *testing.T) {
+	assertQuery(t, Params{Query: "supplier"}, nil, []string{"notes"})
+	assertQuery(t, Params{Query: "supplier", SearchNotes: true},
+		[]string{`"fields":["name^3.000000","description^1.000000","tags^2.000000","notes^1.000000"]`}, nil)
+	// Negations and phrases search notes too.
+	assertQuery(t, Params{Query: `supplier -late`, SearchNotes: true},
+		[]string{`"simple_query_string":`, `"notes^1.000000"`}, nil)
+	// Boosts that already weight notes keep their weight.
+	assertQuery(t, Params{Query: "supplier", SearchNotes: true, Boosts: []FieldBoost{{Field: "name", Boost: 1}, {Field: "notes", Boost: 4}}},
+		[]string{`"fields":["name^1.000000","notes^4.000000"]`}, nil)
+	// Name lookups never touch them.
+	assertQuery(t, Params{Name: "Desk", SearchNotes: true}, nil, []string{"notes"})
+}
+
+func TestExcludeTags(t *testing.T) {
+	assertQuery(t, Params{Query: "desk", ExcludeTags: []string{"clearance", "refurbished"}},
+		[]string{`"must_not":{"terms":{"tags":["clearance","refurbished"]}}`}, nil)
+	// Combined with tags, items need every tag and none of the excluded.
+	assertQuery(t, Params{Tags: []string{"office", "wood"}, ExcludeTags: []string{"clearance"}},
+		[]string{`"filter":[{"term":{"tags":"office"}},{"term":{"tags":"wood"}}]`, `"must_not":{"terms":{"tags":["clearance"]}}`}, nil)
+	assertQuery(t, Params{Query: "desk"}, nil, []string{"must_not"})
+	// Excluding tags alone narrows an export down.
+	if !(Params{ExcludeTags: []string{"clearance"}}).Filtered() {
+		t.Error("excluding tags isn't filtered")
+	}
+}
+
+func TestHasOperators(t *testing.T) {
+	for text, want := range map[string]bool{
+		"monitor":               false,
+		"usb-c cable":           false,
+		"monitor -dell":         true,
+		"+wireless mouse":       true,
+		`"complete with cable"`: true,
+		"desk | table":          true,
+		"- dash alone":          false,
+	} {
+		if got := HasOperators(text); got != want {
+			t.Errorf("HasOperators(%q) = %v, want %v", text, got, want)
+		}
+	}
+}
+
+func TestOperatorQuery(t *testing.T) {
+	operators := []string{`"simple_query_string":`, `"default_operator":"and"`, `"flags":"AND|OR|NOT|PHRASE|PREFIX|PRECEDENCE|WHITESPACE|ESCAPE"`}
+	assertQuery(t, Params{Query: "monitor -dell"},
+		append(operators, `"query":"monitor -dell"`), []string{"multi_match"})
+	assertQuery(t, Params{Query: `"complete with cable"`},
+		append(operators, `"query":"\"complete with cable\""`, `"fields":["name^3.000000","description^1.000000","tags^2.000000"]`), nil)
+	// Operators forces the syntax, plain text otherwise multi_matches.
+	assertQuery(t, Params{Query: "monitor*", Operators: true}, operators, []string{"multi_match"})
+	assertQuery(t, Params{Query: "monitor*"}, []string{`"multi_match":`}, []string{"simple_query_string"})
+	// Refinements are always plain text.
+	assertQuery(t, Params{Query: "monitor -dell", Refine: []string{"-curved"}},
+		[]string{`"multi_match":{"fields":["name^3.000000","description^1.000000","tags^2.000000"],"query":"-curved"}`}, nil)
+}
+
+func TestExcludeName(t *testing.T) {
+	assertQuery(t, Params{Query: "monitor", ExcludeName: "Monitor 24"},
+		[]string{`"must_not":{"term":{"name.raw":"Monitor 24"}}`}, nil)
+	// Next to excluded tags, both are left out.
+	assertQuery(t, Params{Query: "monitor", ExcludeName: "Monitor 24", ExcludeTags: []string{"clearance"}},
+		[]string{`"must_not":[{"terms":{"tags":["clearance"]}},{"term":{"name.raw":"Monitor 24"}}]`}, nil)
+	// On its own it's a search, of everything but that name, so it isn't
+	// scored.
+	p := Params{ExcludeName: "Monitor 24"}
+	if !p.HasQuery() || p.Scored() {
+		t.Errorf("excluding a name alone has HasQuery %v and Scored %v, want a filter-only search", p.HasQuery(), p.Scored())
+	}
+	assertQuery(t, p, []string{`"constant_score":`, `"name.raw":"Monitor 24"`}, nil)
+}
+
+func TestPreferOnly(t *testing.T) {
+	office := []Clause{{Field: "tags", Value: "office", Boost: 2}}
+	// Preferring alone matches everything, ranking preferred items higher.
+	assertQuery(t, Params{Prefer: office},
+		[]string{`"must":{"match_all":{}}`, `"should":{"match":{"tags":{"boost":2,"query":"office"}}}`}, nil)
+	// So does preferring next to exclusions only.
+	assertQuery(t, Params{Prefer: office, ExcludeTags: []string{"clearance"}},
+		[]string{`"must":{"match_all":{}}`, `"must_not":`}, nil)
+	// With anything required, that decides what matches.
+	assertQuery(t, Params{Prefer: office, Query: "desk"}, []string{`"should":`}, []string{"match_all"})
+	assertQuery(t, Params{Prefer: office, Tags: []string{"wood"}}, []string{`"should":`}, []string{"match_all"})
+}
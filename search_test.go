@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"invento-search/schema"
+	"invento-search/search"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAPISearch(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStore(nil)
+	for _, item := range []schema.Item{
+		{SKU: "CBL-USB", Name: "USB cable", Brand: "Acme", Stock: 3},
+		{SKU: "CBL-HDMI", Name: "HDMI cable", Brand: "Acme", Stock: 0},
+		{SKU: "MON-24", Name: "Monitor 24", Brand: "Vista", Stock: 1},
+	} {
+		if _, err := store.Create(ctx, item, RefreshNone); err != nil {
+			t.Fatal(err)
+		}
+	}
+	handler := apiSearchHandler(testConfig(t), store, newSearchStats(16, 100))
+
+	for _, tt := range []struct {
+		query string
+		want  []string
+	}{
+		{"?q=cable", []string{"CBL-HDMI", "CBL-USB"}},
+		{"?q=cable&inStock=true", []string{"CBL-USB"}},
+		{"?q=cable&size=1&from=1", []string{"CBL-USB"}},
+		{"?brand=Vista", []string{"MON-24"}},
+		{"?q=cable&excludeName=USB+cable", []string{"CBL-HDMI"}},
+	} {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("GET", "/api/search"+tt.query, nil))
+		if w.Code != http.StatusOK {
+			t.Errorf("search%s answered %d: %s", tt.query, w.Code, w.Body)
+			continue
+		}
+		var result schema.SearchResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, item := range result.Item {
+			ids = append(ids, item.ID)
+		}
+		if len(ids) != len(tt.want) || (len(ids) > 0 && ids[0] != tt.want[0]) {
+			t.Errorf("search%s found %v, want %v", tt.query, ids, tt.want)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/api/search?q=cable&lang=fr", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("search with lang=fr answered %d, want 400", w.Code)
+	}
+}
+
+func TestSearchDebug(t *testing.T) {
+	params := search.Params{Query: "desk", Boosts: []search.FieldBoost{{Field: "name", Boost: 4}, {Field: "tags", Boost: 1}}}
+	debug, err := searchDebug(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"name^4", "tags^1"}; !reflect.DeepEqual(debug.Boosts, want) {
+		t.Errorf("debug lists boosts %v, want %v", debug.Boosts, want)
+	}
+	if !debug.Scored {
+		t.Error("debug says free text isn't scored")
+	}
+
+	// The builtin boosts apply without any configured.
+	if debug, err = searchDebug(search.Params{Name: "Desk"}); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"name^3", "description^1", "tags^2"}; !reflect.DeepEqual(debug.Boosts, want) {
+		t.Errorf("debug lists boosts %v, want %v", debug.Boosts, want)
+	}
+	if debug.Scored {
+		t.Error("debug says a name lookup is scored")
+	}
+}
+
+// rejectingES fails searches whose body contains reject with status, and
+// answers the rest with a single item.
+func rejectingES(reject string, status int) esHandler {
+	return func(req esRequest) (int, interface{}) {
+		if strings.Contains(req.Body, reject) {
+			return status, map[string]interface{}{
+				"error":  map[string]interface{}{"type": "search_phase_execution_exception", "reason": "all shards failed"},
+				"status": status,
+			}
+		}
+		return http.StatusOK, searchHits(map[string]interface{}{"desk-1": map[string]interface{}{"name": "Desk"}})
+	}
+}
+
+func TestSearchFallback(t *testing.T) {
+	cfg := testConfig(t)
+	run := func(handler esHandler, query string) (*httptest.ResponseRecorder, *fakeES) {
+		client, es := newFakeES(t, handler)
+		w := httptest.NewRecorder()
+		apiSearchHandler(cfg, newESStore(cfg, client, nil), newSearchStats(16, 100))(w, httptest.NewRequest("GET", "/api/search"+query, nil))
+		return w, es
+	}
+
+	// A clause Elasticsearch can't apply is dropped for the fallback.
+	w, es := run(rejectingES(`"created"`, http.StatusBadRequest), "?q=desk&require=created:yesterday")
+	if w.Code != http.StatusOK {
+		t.Fatalf("search answered %d: %s", w.Code, w.Body)
+	}
+	var result schema.SearchResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	if !result.Degraded || result.Warning != degradedWarning || len(result.Item) != 1 {
+		t.Errorf("fallback answered %+v, want the item, degraded with a warning", result)
+	}
+	searches := es.requestsTo("POST", "/_search")
+	if len(searches) != 2 || !strings.Contains(searches[1].Body, `"desk"`) || strings.Contains(searches[1].Body, `"created"`) {
+		t.Errorf("searched %v, want the fallback to search the text without the clause", searches)
+	}
+
+	// Searches that work aren't degraded.
+	w, _ = run(rejectingES(`"created"`, http.StatusBadRequest), "?q=desk")
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), "degraded") {
+		t.Errorf("search answered %d: %s", w.Code, w.Body)
+	}
+
+	// Other errors aren't retried.
+	w, es = run(rejectingES(`"created"`, http.StatusInternalServerError), "?q=desk&require=created:yesterday")
+	if w.Code != http.StatusInternalServerError || len(es.requestsTo("POST", "/_search")) != 1 {
+		t.Errorf("search failing with 500 answered %d after %d searches", w.Code, len(es.requestsTo("POST", "/_search")))
+	}
+
+	// Nor is a failing fallback, which reports the original error.
+	w, _ = run(rejectingES(`"desk"`, http.StatusBadRequest), "?q=desk")
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("search with a failing fallback answered %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestSearchParamsMode(t *testing.T) {
+	cfg := testConfig(t)
+	for query, archived := range map[string]bool{
+		"?q=desk":            false,
+		"?q=desk&mode=admin": true,
+		"?q=desk&mode=admin&includeArchived=false": false,
+		"?q=desk&includeArchived=true":             true,
+	} {
+		params, err := parseSearchParams(cfg, httptest.NewRequest("GET", "/api/search"+query, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if params.IncludeArchived != archived || (!strings.Contains(query, "mode") && (params.InStock || params.Recency)) {
+			t.Errorf("search%s has includeArchived %v, inStock %v and recency %v", query, params.IncludeArchived, params.InStock, params.Recency)
+		}
+	}
+}
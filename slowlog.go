@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"gopkg.in/olivere/elastic.v6"
+	"invento-search/search"
+	"time"
+)
+
+// logSlowSearch logs a warning for searches whose round trip to
+// Elasticsearch took longer than SLOW_SEARCH_THRESHOLD, with the params,
+// the query sent and the time Elasticsearch itself reported. Comparing
+// the two tells network and queueing delays apart from slow queries.
+func logSlowSearch(ctx context.Context, cfg Config, params search.Params, query elastic.Query, elapsed time.Duration, tookMillis int64) {
+	if elapsed < cfg.SlowSearchThreshold {
+		return
+	}
+	logf(ctx, "WARN slow search took %s (%dms in Elasticsearch), params %+v, query %s\n",
+		elapsed.Round(time.Millisecond), tookMillis, params, querySource(query))
+}
+
+// querySource serializes query for logging.
+func querySource(query elastic.Query) string {
+	source, err := query.Source()
+	if err != nil {
+		return "unavailable: " + err.Error()
+	}
+	body, err := json.Marshal(source)
+	if err != nil {
+		return "unavailable: " + err.Error()
+	}
+	return string(body)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/csv"
+	"gopkg.in/olivere/elastic.v6"
+	"invento-search/schema"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// lowStockHandler lists the items with stock below a threshold, lowest
+// first, for the reorder report. The threshold defaults to
+// LOW_STOCK_THRESHOLD and results are paged with from and size.
+func lowStockHandler(cfg Config, client *elastic.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		threshold := cfg.LowStockThreshold
+		if v := r.FormValue("threshold"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				http.Error(w, "threshold must be a non-negative number", http.StatusBadRequest)
+				return
+			}
+			threshold = n
+		}
+		params, err := parseSearchParams(cfg, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		searchResult, err := client.Search().
+			Index(cfg.IndexName).
+			Query(elastic.NewBoolQuery().Filter(elastic.NewRangeQuery("stock").Lt(threshold))).
+			Sort("stock", true).
+			Sort("name.raw", true).
+			From(params.From).Size(params.Size).
+			Do(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		response := schema.SearchResponse{Item: []schema.Item{}, Total: searchResult.Hits.TotalHits}
+		for _, hit := range searchResult.Hits.Hits {
+			item, err := decodeItemSource(hit.Source, hit.Id)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			response.Item = append(response.Item, item)
+		}
+		writeJSON(w, r, http.StatusOK, response)
+	}
+}
+
+// stockRow is a parsed line of a stock CSV.
+type stockRow struct {
+	line  int
+	sku   string
+	stock int
+}
+
+// stockFailure is a CSV line that couldn't be applied.
+type stockFailure struct {
+	Line   int    `json:"line"`
+	SKU    string `json:"sku,omitempty"`
+	Reason string `json:"reason"`
+}
+
+// stockReport is the /api/stock/bulk response body.
+type stockReport struct {
+	Updated []string       `json:"updated"`
+	Unknown []string       `json:"unknown"`
+	Failed  []stockFailure `json:"failed"`
+	// Aborted says why the update stopped early, if it did. Pending then
+	// lists the SKUs that weren't sent, or whose result didn't come back
+	// in time. Those that were sent may still be applied.
+	Aborted string   `json:"aborted,omitempty"`
+	Pending []string `json:"pending,omitempty"`
+}
+
+// bulkStockHandler applies a stocktake. The body is a CSV of sku,stock
+// lines, with an optional header. Updates address items by SKU and are
+// written in bulk, see ItemStore.Bulk, and the store is refreshed once all
+// are confirmed.
+//
+// If the client goes away or the request's deadline passes, no further
+// updates are queued and the report covers what was confirmed so far.
+func bulkStockHandler(store ItemStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		report := stockReport{Updated: []string{}, Unknown: []string{}, Failed: []stockFailure{}}
+		rows, failures, err := parseStockCSV(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		report.Failed = append(report.Failed, failures...)
+
+		// Writes are keyed by row, so the report keeps the CSV order.
+		ctx := r.Context()
+		writer := store.Bulk()
+		for i := 0; i < len(rows) && ctx.Err() == nil; i++ {
+			writer.SetStock(ctx, i, rows[i].sku, rows[i].stock)
+		}
+		outcomes := writer.Wait(ctx)
+
+		for i, row := range rows {
+			outcome, confirmed := outcomes[i]
+			switch {
+			case !confirmed:
+				report.Pending = append(report.Pending, row.sku)
+			case elastic.IsNotFound(outcome.Err):
+				report.Unknown = append(report.Unknown, row.sku)
+			case outcome.Err != nil:
+				report.Failed = append(report.Failed, stockFailure{Line: row.line, SKU: row.sku, Reason: esErrorReason(outcome.Err)})
+			default:
+				report.Updated = append(report.Updated, row.sku)
+			}
+		}
+
+		if len(report.Pending) > 0 {
+			// Only a done context leaves rows pending. The periodic
+			// refresh picks up what was applied.
+			report.Aborted = ctx.Err().Error()
+			logf(r.Context(), "Bulk stock update aborted (%s): %d updated, %d pending\n", report.Aborted, len(report.Updated), len(report.Pending))
+			writeJSON(w, r, http.StatusServiceUnavailable, report)
+			return
+		}
+		if len(report.Updated) > 0 {
+			if err := store.Refresh(ctx); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		logf(r.Context(), "Bulk stock update: %d updated, %d unknown, %d failed\n", len(report.Updated), len(report.Unknown), len(report.Failed))
+		writeJSON(w, r, http.StatusOK, report)
+	}
+}
+
+// parseStockCSV reads sku,stock lines. Lines with a bad SKU or stock value
+// are returned as failures, a header line is skipped.
+func parseStockCSV(body io.Reader) ([]stockRow, []stockFailure, error) {
+	reader := csv.NewReader(body)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	var (
+		rows     []stockRow
+		failures []stockFailure
+	)
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(record) != 2 {
+			failures = append(failures, stockFailure{Line: line, Reason: "want 2 columns, sku and stock"})
+			continue
+		}
+		sku, value := strings.TrimSpace(record[0]), strings.TrimSpace(record[1])
+		stock, err := strconv.Atoi(value)
+		if line == 1 && err != nil {
+			// Header line.
+			continue
+		}
+		switch {
+		case sku == "":
+			failures = append(failures, stockFailure{Line: line, Reason: "sku is empty"})
+		case err != nil:
+			failures = append(failures, stockFailure{Line: line, SKU: sku, Reason: "stock must be a whole number"})
+		case stock < 0:
+			failures = append(failures, stockFailure{Line: line, SKU: sku, Reason: "stock can't be negative"})
+		default:
+			rows = append(rows, stockRow{line: line, sku: sku, stock: stock})
+		}
+	}
+	return rows, failures, nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"invento-search/schema"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestBulkStock(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStore(nil)
+	for _, item := range []schema.Item{
+		{SKU: "MON-24", Name: "Monitor 24", Stock: 1},
+		{SKU: "CBL-USB", Name: "USB cable", Stock: 1},
+	} {
+		if _, err := store.Create(ctx, item, RefreshNone); err != nil {
+			t.Fatal(err)
+		}
+	}
+	body := "sku,stock\nMON-24,7\nKBD-01,3\nCBL-USB,lots\nCBL-USB,0\n"
+
+	w := httptest.NewRecorder()
+	bulkStockHandler(store)(w, httptest.NewRequest("POST", "/api/stock/bulk", strings.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("bulk stock answered %d: %s", w.Code, w.Body)
+	}
+	var report stockReport
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"MON-24", "CBL-USB"}; !reflect.DeepEqual(report.Updated, want) {
+		t.Errorf("updated %v, want %v", report.Updated, want)
+	}
+	if want := []string{"KBD-01"}; !reflect.DeepEqual(report.Unknown, want) {
+		t.Errorf("unknown %v, want %v", report.Unknown, want)
+	}
+	if len(report.Failed) != 1 || report.Failed[0].Line != 4 {
+		t.Errorf("failed %+v, want line 4", report.Failed)
+	}
+	for sku, stock := range map[string]int{"MON-24": 7, "CBL-USB": 0} {
+		if item, err := store.Get(ctx, sku); err != nil || item.Stock != stock {
+			t.Errorf("%s is %+v (%v), want stock %d", sku, item, err, stock)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	bulkStockHandler(store)(w, httptest.NewRequest("GET", "/api/stock/bulk", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET answered %d, want 405", w.Code)
+	}
+}
@@ -0,0 +1,500 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"gopkg.in/olivere/elastic.v6"
+	"invento-search/schema"
+	"invento-search/search"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// RefreshPolicy controls when a write becomes visible to search.
+type RefreshPolicy string
+
+const (
+	// RefreshNone returns straight away, the write shows up after the next
+	// periodic refresh. Best for throughput.
+	RefreshNone RefreshPolicy = "false"
+	// RefreshWaitFor waits until the write is visible to search.
+	RefreshWaitFor RefreshPolicy = "wait_for"
+	// RefreshNow forces a refresh of the affected shards. Expensive, so
+	// prefer RefreshWaitFor.
+	RefreshNow RefreshPolicy = "true"
+)
+
+// ItemStore is where the pages and the item API endpoints read and write
+// items. esStore keeps them in Elasticsearch, memoryStore in memory for
+// tests that shouldn't need a cluster.
+//
+// Missing items are errors elastic.IsNotFound reports true for, and ids
+// that are taken elastic.IsConflict, whichever the store.
+type ItemStore interface {
+	// Get returns the item with the given id.
+	Get(ctx context.Context, id string) (schema.Item, error)
+	// GetMany returns the items with the given ids in the order given,
+	// skipping ids of items that don't exist.
+	GetMany(ctx context.Context, ids []string) ([]schema.Item, error)
+	// Search returns a page of the items matching params.
+	Search(ctx context.Context, params search.Params) (schema.SearchResponse, error)
+	// FindDuplicate looks for an item with the same name and description
+	// as item.
+	FindDuplicate(ctx context.Context, item schema.Item) (schema.Item, bool, error)
+	// Create stores a new item and returns its id, see prepareItem.
+	Create(ctx context.Context, item schema.Item, refresh RefreshPolicy) (string, error)
+	// Update applies a partial update document to the item with the given
+	// id.
+	Update(ctx context.Context, id string, doc map[string]interface{}, refresh RefreshPolicy) error
+	// Delete removes the item with the given id. It reports false if there
+	// was no such item.
+	Delete(ctx context.Context, id string, refresh RefreshPolicy) (bool, error)
+	// Export calls each with every item matching params, ignoring paging,
+	// and stops at the first error each returns.
+	Export(ctx context.Context, params search.Params, each func(schema.Item) error) error
+	// Bulk starts a batch of writes, for the bulk endpoints.
+	Bulk() bulkWriter
+	// Refresh makes the writes so far visible to search.
+	Refresh(ctx context.Context) error
+}
+
+// esStore reads and writes items in an Elasticsearch index, publishing an
+// event on events after every successful write.
+//
+// With routing on, items are routed to shards by category, so an item's
+// shard can't be told from its id alone. Reads and writes by id then look
+// up the routing the item was indexed with first, see routingFor.
+type esStore struct {
+	cfg     Config
+	client  *elastic.Client
+	index   string
+	events  *eventBus
+	routing bool
+	// written has the routing of the items written lately, which the
+	// routing lookup can't find yet.
+	written *recentRoutings
+
+	// bulk is the long-lived bulk processor bulk endpoints feed, see
+	// StartBulk.
+	bulk      *elastic.BulkProcessor
+	bulkStats bulkStats
+}
+
+// newESStore returns a store for the items index in cfg, routing items by
+// category if ROUTE_BY_CATEGORY is set.
+func newESStore(cfg Config, client *elastic.Client, events *eventBus) *esStore {
+	return &esStore{cfg: cfg, client: client, index: cfg.IndexName, events: events, routing: cfg.RouteByCategory, written: newRecentRoutings()}
+}
+
+// Create indexes a new item. It's stored under item.ID if set, or else its
+// SKU, so stock updates can address it by SKU. Creating an item whose id is
+// taken fails with a conflict rather than overwriting it. The item's name is
+// used for autocomplete suggestions unless it brings its own, its tags are
+// normalized, and its creation time is stamped unless already set, and
+// converted to UTC.
+//
+// Ids are only unique per shard, so with routing on an id taken in another
+// category is checked for explicitly.
+func (s *esStore) Create(ctx context.Context, item schema.Item, refresh RefreshPolicy) (string, error) {
+	item, id := prepareItem(item)
+	service := s.client.Index().
+		Index(s.index).
+		Type("item").
+		BodyJson(item).
+		Refresh(string(refresh))
+	if id != "" {
+		service = service.Id(id).OpType("create")
+	}
+	if s.routing && item.Category != "" {
+		if id != "" {
+			routings, err := s.routings(ctx, []string{id})
+			if err != nil {
+				return "", err
+			}
+			if _, taken := routings[id]; taken {
+				return "", &elastic.Error{Status: http.StatusConflict, Details: &elastic.ErrorDetails{
+					Type:   "version_conflict_engine_exception",
+					Reason: fmt.Sprintf("[item][%s]: version conflict, document already exists", id),
+				}}
+			}
+		}
+		service = service.Routing(item.Category)
+	}
+	res, err := service.Do(ctx)
+	if err != nil {
+		return "", err
+	}
+	s.rememberRouting(res.Id, item.Category)
+	s.events.publish(itemEvent{Type: itemCreated, ItemID: res.Id, RequestID: requestID(ctx)})
+	return res.Id, nil
+}
+
+// prepareItem fills in what's derived when an item is first stored, and
+// returns it with the id to store it under, "" for a generated one.
+func prepareItem(item schema.Item) (schema.Item, string) {
+	if item.Suggest == nil {
+		item.Suggest = elastic.NewSuggestField(item.Name)
+	}
+	item.Tags = normalizeTags(item.Tags)
+	if item.Created.IsZero() {
+		item.Created = time.Now()
+	}
+	// Stored in UTC whatever the offset it came with, so date ranges and
+	// sorting don't depend on the writer's time zone.
+	item.Created = item.Created.UTC()
+	id := item.ID
+	if id == "" {
+		id = item.SKU
+	}
+	item.ID = ""
+	return item, id
+}
+
+// Get fetches and decodes the item with the given id.
+func (s *esStore) Get(ctx context.Context, id string) (schema.Item, error) {
+	res, err := s.Raw(ctx, id)
+	if err != nil {
+		return schema.Item{}, err
+	}
+	return decodeItemSource(res.Source, res.Id)
+}
+
+// Raw fetches the item document with the given id as Elasticsearch returns
+// it, with its metadata. A missing item is an error elastic.IsNotFound
+// reports true for.
+func (s *esStore) Raw(ctx context.Context, id string) (*elastic.GetResult, error) {
+	routing, err := s.routingFor(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	service := s.client.Get().
+		Index(s.index).
+		Type("item").
+		Id(id)
+	if routing != "" {
+		service = service.Routing(routing)
+	}
+	return service.Do(ctx)
+}
+
+// GetMany fetches the items with the given ids in one request, in the
+// order given. Ids of items that don't exist (anymore) are skipped.
+func (s *esStore) GetMany(ctx context.Context, ids []string) ([]schema.Item, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	var routings map[string]string
+	if s.routing {
+		var err error
+		if routings, err = s.routings(ctx, ids); err != nil {
+			return nil, err
+		}
+	}
+	mget := s.client.MultiGet()
+	gets := 0
+	for _, id := range ids {
+		routing, found := routings[id]
+		if s.routing && !found {
+			continue
+		}
+		get := elastic.NewMultiGetItem().Index(s.index).Type("item").Id(id)
+		if routing != "" {
+			get = get.Routing(routing)
+		}
+		mget.Add(get)
+		gets++
+	}
+	if gets == 0 {
+		return nil, nil
+	}
+	res, err := mget.Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var items []schema.Item
+	for _, doc := range res.Docs {
+		if !doc.Found {
+			continue
+		}
+		item, err := decodeItemSource(doc.Source, doc.Id)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// Update applies a partial update document to the item with the given id,
+// leaving fields not in doc as they are. Changing the category of a routed
+// item doesn't move it, it stays on the shard of its original category.
+func (s *esStore) Update(ctx context.Context, id string, doc map[string]interface{}, refresh RefreshPolicy) error {
+	routing, err := s.routingFor(ctx, id)
+	if err != nil {
+		return err
+	}
+	service := s.client.Update().
+		Index(s.index).
+		Type("item").
+		Id(id).
+		Doc(doc).
+		Refresh(string(refresh))
+	if routing != "" {
+		service = service.Routing(routing)
+	}
+	res, err := service.Do(ctx)
+	if err != nil {
+		return err
+	}
+	logf(ctx, "Item %s is now in version %d\n", id, res.Version)
+	s.events.publish(itemEvent{Type: itemUpdated, ItemID: id, RequestID: requestID(ctx)})
+	return nil
+}
+
+// Delete removes the item with the given id. It reports false if there was
+// no such item.
+func (s *esStore) Delete(ctx context.Context, id string, refresh RefreshPolicy) (bool, error) {
+	routing, err := s.routingFor(ctx, id)
+	if elastic.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	service := s.client.Delete().
+		Index(s.index).
+		Type("item").
+		Id(id).
+		Refresh(string(refresh))
+	if routing != "" {
+		service = service.Routing(routing)
+	}
+	_, err = service.Do(ctx)
+	s.written.forget(id)
+	if elastic.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	s.events.publish(itemEvent{Type: itemDeleted, ItemID: id, RequestID: requestID(ctx)})
+	return true, nil
+}
+
+// Search runs the search described by params, falling back to a simpler
+// one if Elasticsearch rejects it, see searchWithFallback.
+func (s *esStore) Search(ctx context.Context, params search.Params) (schema.SearchResponse, error) {
+	return searchWithFallback(ctx, s.cfg, s.client, params)
+}
+
+// FindDuplicate looks for an item with exactly the same name and
+// description as item. The name is matched on name.raw, and since the
+// description is only indexed as text, phrase matches are compared
+// exactly as well. An empty description has no terms to match a phrase
+// with, so items without one are looked for instead.
+func (s *esStore) FindDuplicate(ctx context.Context, item schema.Item) (schema.Item, bool, error) {
+	query := elastic.NewBoolQuery().Filter(elastic.NewTermQuery("name.raw", item.Name))
+	if item.Description == "" {
+		query = query.MustNot(elastic.NewExistsQuery("description"))
+	} else {
+		query = query.Filter(elastic.NewMatchPhraseQuery("description", item.Description))
+	}
+	res, err := s.client.Search().
+		Index(s.index).
+		Query(query).
+		Size(10).
+		Do(ctx)
+	if err != nil {
+		return schema.Item{}, false, err
+	}
+	for _, hit := range res.Hits.Hits {
+		existing, err := decodeItemSource(hit.Source, hit.Id)
+		if err != nil {
+			return schema.Item{}, false, err
+		}
+		if existing.Name == item.Name && existing.Description == item.Description {
+			return existing, true, nil
+		}
+	}
+	return schema.Item{}, false, nil
+}
+
+// routingFor returns the routing the item with the given id was indexed
+// with, "" if routing is off or the item has none. An unknown id is an
+// error elastic.IsNotFound reports true for.
+func (s *esStore) routingFor(ctx context.Context, id string) (string, error) {
+	if !s.routing {
+		return "", nil
+	}
+	routings, err := s.routings(ctx, []string{id})
+	if err != nil {
+		return "", err
+	}
+	routing, found := routings[id]
+	if !found {
+		return "", &elastic.Error{Status: http.StatusNotFound, Details: &elastic.ErrorDetails{
+			Type:   "document_missing_exception",
+			Reason: fmt.Sprintf("[item][%s]: document missing", id),
+		}}
+	}
+	return routing, nil
+}
+
+// routings maps the given ids to the routing each item was indexed with,
+// leaving out unknown ids. Unlike a get this is a search across all shards,
+// so an item only shows up once the index was refreshed after it was
+// created. Until then, items this process wrote are found in s.written.
+func (s *esStore) routings(ctx context.Context, ids []string) (map[string]string, error) {
+	routings := make(map[string]string, len(ids))
+	var unknown []string
+	for _, id := range ids {
+		if routing, found := s.written.lookup(id); found {
+			routings[id] = routing
+		} else {
+			unknown = append(unknown, id)
+		}
+	}
+	if len(unknown) == 0 {
+		return routings, nil
+	}
+	res, err := s.client.Search().
+		Index(s.index).
+		Query(elastic.NewIdsQuery("item").Ids(unknown...)).
+		FetchSource(false).
+		Size(len(unknown)).
+		Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, hit := range res.Hits.Hits {
+		routings[hit.Id] = hit.Routing
+	}
+	return routings, nil
+}
+
+// rememberRouting records the routing an item was just written with, for
+// routings to find before the next refresh.
+func (s *esStore) rememberRouting(id, routing string) {
+	if s.routing && routing != "" {
+		s.written.add(id, routing)
+	}
+}
+
+// recentRoutingTTL is how long the routing of a written item is
+// remembered, well beyond the refresh interval after which the routing
+// lookup finds it.
+const recentRoutingTTL = time.Minute
+
+// recentRoutings remembers the routing of items for recentRoutingTTL
+// after they were written. It only knows about this process's writes, so
+// other instances still have to wait for a refresh.
+type recentRoutings struct {
+	mu      sync.Mutex
+	entries map[string]recentRouting
+	pruned  time.Time
+}
+
+type recentRouting struct {
+	routing string
+	written time.Time
+}
+
+func newRecentRoutings() *recentRoutings {
+	return &recentRoutings{entries: map[string]recentRouting{}, pruned: time.Now()}
+}
+
+func (r *recentRoutings) add(id, routing string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	r.entries[id] = recentRouting{routing: routing, written: now}
+	// Prune at most once per TTL, so big imports don't rescan all the
+	// entries per item.
+	if now.Sub(r.pruned) > recentRoutingTTL {
+		for id, entry := range r.entries {
+			if now.Sub(entry.written) > recentRoutingTTL {
+				delete(r.entries, id)
+			}
+		}
+		r.pruned = now
+	}
+}
+
+func (r *recentRoutings) lookup(id string) (string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	entry, found := r.entries[id]
+	if !found || time.Since(entry.written) > recentRoutingTTL {
+		return "", false
+	}
+	return entry.routing, true
+}
+
+func (r *recentRoutings) forget(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.entries, id)
+}
+
+// Export scrolls through the items matching params, see exportHandler.
+// The scroll context gives the same consistent snapshot for as long as the
+// export runs, and it's cleared when the export ends, early or not. Pages
+// are sorted by _doc, the cheapest order to scroll in.
+func (s *esStore) Export(ctx context.Context, params search.Params, each func(schema.Item) error) error {
+	scroll := s.client.Scroll(searchIndices(s.cfg, params)...).
+		IgnoreUnavailable(true).
+		Query(search.BuildQuery(params)).
+		Sort("_doc", true).
+		Size(exportBatchSize).
+		KeepAlive("1m")
+	// Clear even when the client went away, which cancels ctx.
+	defer scroll.Clear(context.Background())
+
+	for {
+		res, err := scroll.Do(ctx)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for _, hit := range res.Hits.Hits {
+			item, err := decodeItemSource(hit.Source, hit.Id)
+			if err != nil {
+				return err
+			}
+			if err := each(item); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Refresh refreshes the index, making the writes so far visible to search.
+func (s *esStore) Refresh(ctx context.Context) error {
+	_, err := s.client.Refresh(s.index).Do(ctx)
+	return err
+}
+
+// Flush makes sure previous writes are persisted.
+func (s *esStore) Flush(ctx context.Context) error {
+	_, err := s.client.Flush().Index(s.index).Do(ctx)
+	return err
+}
+
+// decodeItemSource decodes a document's _source into an item and stamps the
+// document id into it.
+func decodeItemSource(raw *json.RawMessage, id string) (schema.Item, error) {
+	var item schema.Item
+	if raw == nil {
+		return item, fmt.Errorf("document %s has no source", id)
+	}
+	if err := json.Unmarshal(*raw, &item); err != nil {
+		return item, fmt.Errorf("decoding document %s: %v", id, err)
+	}
+	item.ID = id
+	return item, nil
+}
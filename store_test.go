@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"gopkg.in/olivere/elastic.v6"
+	"invento-search/schema"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestFindDuplicate(t *testing.T) {
+	existing := map[string]interface{}{
+		"name":        "Monitor 24",
+		"description": "",
+	}
+	client, es := newFakeES(t, func(req esRequest) (int, interface{}) {
+		return http.StatusOK, searchHits(map[string]interface{}{"monitor-24": existing})
+	})
+	store := newESStore(testConfig(t), client, nil)
+
+	found, ok, err := store.FindDuplicate(context.Background(), schema.Item{Name: "Monitor 24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || found.ID != "monitor-24" {
+		t.Errorf("FindDuplicate = %q, %v, want monitor-24, true", found.ID, ok)
+	}
+	body := es.requestsTo("POST", "/_search")[0].Body
+	// A phrase of nothing matches nothing, so an empty description must be
+	// looked for as a missing one.
+	if strings.Contains(body, "match_phrase") || !strings.Contains(body, `"must_not":{"exists":{"field":"description"}}`) {
+		t.Errorf("empty description searched with %s", body)
+	}
+
+	// Hits are compared exactly, the phrase may match more.
+	_, ok, err = store.FindDuplicate(context.Background(), schema.Item{Name: "Monitor 24", Description: "Full HD"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Error("FindDuplicate found an item with another description")
+	}
+	body = es.requestsTo("POST", "/_search")[1].Body
+	if !strings.Contains(body, `"match_phrase":{"description":{"query":"Full HD"}}`) {
+		t.Errorf("description searched with %s", body)
+	}
+}
+
+// routedES is a cluster holding items indexed with routing, which searches
+// don't find yet because the index wasn't refreshed since.
+func routedES(t *testing.T) esHandler {
+	docs := map[string]esRequest{}
+	return func(req esRequest) (int, interface{}) {
+		switch {
+		case strings.HasSuffix(req.Path, "/_search"):
+			return http.StatusOK, searchHits(nil)
+		case req.Method == "PUT":
+			id := strings.TrimPrefix(req.Path, "/items/item/")
+			docs[id] = req
+			return http.StatusCreated, map[string]interface{}{"_index": "items", "_type": "item", "_id": id, "_version": 1, "result": "created"}
+		case strings.HasSuffix(req.Path, "/_update"):
+			id := strings.TrimSuffix(strings.TrimPrefix(req.Path, "/items/item/"), "/_update")
+			if doc, found := docs[id]; !found || doc.Query.Get("routing") != req.Query.Get("routing") {
+				return http.StatusNotFound, map[string]interface{}{"status": 404, "error": map[string]string{"type": "document_missing_exception"}}
+			}
+			return http.StatusOK, map[string]interface{}{"_index": "items", "_type": "item", "_id": id, "_version": 2, "result": "updated"}
+		case req.Method == "GET":
+			id := strings.TrimPrefix(req.Path, "/items/item/")
+			doc, found := docs[id]
+			if !found || doc.Query.Get("routing") != req.Query.Get("routing") {
+				return http.StatusNotFound, esNotFound(id)
+			}
+			return http.StatusOK, map[string]interface{}{"_index": "items", "_type": "item", "_id": id, "_routing": req.Query.Get("routing"), "found": true, "_source": json.RawMessage(doc.Body)}
+		case req.Method == "DELETE":
+			return http.StatusOK, map[string]interface{}{"_index": "items", "_type": "item", "_id": "", "result": "deleted"}
+		}
+		t.Errorf("unexpected request %s %s", req.Method, req.Path)
+		return http.StatusBadRequest, map[string]interface{}{}
+	}
+}
+
+func TestRoutedCreateThenEdit(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.RouteByCategory = true
+	client, es := newFakeES(t, routedES(t))
+	store := newESStore(cfg, client, nil)
+	ctx := context.Background()
+
+	id, err := store.Create(ctx, schema.Item{SKU: "CBL-001", Name: "USB cable", Category: "cables"}, RefreshNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creates := es.requestsTo("PUT", "/items/item/CBL-001"); len(creates) != 1 || creates[0].Query.Get("routing") != "cables" {
+		t.Fatalf("created with %v, want routing by category", creates)
+	}
+
+	// The item isn't searchable yet, but its routing is known.
+	if err := store.Update(ctx, id, map[string]interface{}{"stock": 3}, RefreshNone); err != nil {
+		t.Fatalf("updating a just created item: %v", err)
+	}
+	item, err := store.Get(ctx, id)
+	if err != nil {
+		t.Fatalf("getting a just created item: %v", err)
+	}
+	if item.ID != "CBL-001" || item.Name != "USB cable" {
+		t.Errorf("got %+v", item)
+	}
+	if _, err := store.Create(ctx, schema.Item{SKU: "CBL-001", Name: "USB cable", Category: "adapters"}, RefreshNone); !elastic.IsConflict(err) {
+		t.Errorf("creating a taken SKU in another category = %v, want a conflict", err)
+	}
+
+	deleted, err := store.Delete(ctx, id, RefreshNone)
+	if err != nil || !deleted {
+		t.Fatalf("Delete = %v, %v", deleted, err)
+	}
+	if deletes := es.requestsTo("DELETE", "/items/item/CBL-001"); len(deletes) != 1 || deletes[0].Query.Get("routing") != "cables" {
+		t.Errorf("deleted with %v, want the routing", deletes)
+	}
+	// Once deleted the routing is forgotten, and the lookup searches.
+	if _, err := store.Get(ctx, id); !elastic.IsNotFound(err) {
+		t.Errorf("getting a deleted item = %v, want not found", err)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"embed"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// builtinTemplates are the templates compiled into the binary, used when
+// the template directory doesn't exist.
+//
+//go:embed templates/*.html
+var builtinTemplates embed.FS
+
+// requiredTemplates are the templates the handlers render. A template
+// directory must provide all of them, and may add its own to include.
+var requiredTemplates = []string{
+	"landing-page.html",
+	"item.html",
+	"create.html",
+	"list.html",
+	"edit.html",
+	"maintenance.html",
+}
+
+// loadTemplates parses the *.html templates in dir, or the builtin ones if
+// there's no such directory, and checks none of the required ones is
+// missing.
+func loadTemplates(dir string, funcs template.FuncMap) (*template.Template, error) {
+	var files fs.FS
+	if info, err := os.Stat(dir); err == nil && info.IsDir() {
+		files = os.DirFS(dir)
+	} else {
+		fmt.Printf("Template directory %s not found, using the builtin templates\n", dir)
+		files, _ = fs.Sub(builtinTemplates, "templates")
+	}
+	templates, err := template.New("").Funcs(funcs).ParseFS(files, "*.html")
+	if err != nil {
+		return nil, fmt.Errorf("parsing the templates in %s: %v", dir, err)
+	}
+	var missing []string
+	for _, name := range requiredTemplates {
+		if templates.Lookup(name) == nil {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("template directory %s is missing %s", dir, strings.Join(missing, ", "))
+	}
+	return templates, nil
+}
+
+// lowStockLimit is the highest stock still shown as low.
+const lowStockLimit = 5
+
+// templateFuncs returns the helpers available to every template.
+func templateFuncs(cfg Config) template.FuncMap {
+	return template.FuncMap{
+		"stockStatus": stockStatus,
+		"join":        strings.Join,
+		"pageURL":     pageURL,
+		"add":         func(a, b int) int { return a + b },
+		"formatDate":  dateFormatter(cfg.DateFormat, cfg.TimeZone),
+	}
+}
+
+// dateFormatter returns a func rendering times in layout, in the time zone
+// loc, and unset times as "unknown".
+func dateFormatter(layout string, loc *time.Location) func(time.Time) string {
+	return func(t time.Time) string {
+		if t.IsZero() {
+			return "unknown"
+		}
+		return t.In(loc).Format(layout)
+	}
+}
+
+// pageURL links to page n of the search in query, size results a page.
+func pageURL(query url.Values, n, size int) string {
+	page := url.Values{}
+	for key, values := range query {
+		page[key] = values
+	}
+	if n > 1 {
+		page.Set("from", strconv.Itoa((n-1)*size))
+	}
+	return "/search/?" + page.Encode()
+}
+
+// stockStatus describes a stock level for display.
+func stockStatus(n int) string {
+	switch {
+	case n <= 0:
+		return "Out of stock"
+	case n <= lowStockLimit:
+		return "Low"
+	default:
+		return "In stock"
+	}
+}
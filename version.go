@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+	"runtime"
+	"time"
+)
+
+// Build details, set with -ldflags "-X main.version=... -X main.commit=...".
+var (
+	version = "dev"
+	commit  = "unknown"
+)
+
+// started is when the process started, for the uptime.
+var started = time.Now()
+
+// versionInfo is the /version response body.
+type versionInfo struct {
+	Version       string    `json:"version"`
+	Commit        string    `json:"commit"`
+	GoVersion     string    `json:"go_version"`
+	Started       time.Time `json:"started"`
+	Uptime        string    `json:"uptime"`
+	UptimeSeconds int64     `json:"uptime_seconds"`
+}
+
+// versionHandler reports which build is running and for how long.
+func versionHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		uptime := time.Since(started)
+		writeJSON(w, r, http.StatusOK, versionInfo{
+			Version:       version,
+			Commit:        commit,
+			GoVersion:     runtime.Version(),
+			Started:       started.UTC(),
+			Uptime:        uptime.Round(time.Second).String(),
+			UptimeSeconds: int64(uptime / time.Second),
+		})
+	}
+}